@@ -1,144 +1,146 @@
 package atomfs
 
 import (
-	"crypto/sha256"
-	"fmt"
+	"database/sql"
 	"io"
 	"io/ioutil"
 	"os"
 
 	"github.com/anuvu/atomfs/db"
+	"github.com/anuvu/atomfs/storage"
 	"github.com/anuvu/atomfs/types"
 	"github.com/schollz/sqlite3dump"
 )
 
+// ErrReadOnly is returned by mutating operations on an Instance that was
+// opened with Config.ReadOnly. It is the same error as types.ErrReadOnly.
+var ErrReadOnly = types.ErrReadOnly
+
 type Instance struct {
-	config types.Config
-	db     *db.AtomfsDB
+	config       types.Config
+	db           *db.AtomfsDB
+	storage      storage.Storage
+	eventHandler func(Event)
+	verifier     Verifier
+	metrics      Metrics
+	refs         *refs
+
+	// pendingEvents is non-nil for an Instance inside a Tx; events are
+	// queued here until the transaction commits.
+	pendingEvents *[]Event
 }
 
 func New(config types.Config) (*Instance, error) {
-	if err := os.MkdirAll(config.Path, 0755); err != nil {
-		if !os.IsExist(err) {
-			return nil, err
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	if !config.ReadOnly {
+		for _, dir := range []string{config.Path, config.AtomsPath()} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				if !os.IsExist(err) {
+					return nil, err
+				}
+			}
 		}
 	}
 
+	config.Log().Debug("opening db", "path", config.Path, "readOnly", config.ReadOnly)
 	db, err := db.New(config)
 	if err != nil {
 		return nil, err
 	}
+	config.Log().Info("opened db", "path", config.Path)
 
-	return &Instance{config: config, db: db}, nil
+	return &Instance{config: config, db: db, storage: config.AtomStorage(), refs: newRefs()}, nil
 }
 
-func (atomfs *Instance) Close() error {
-	return atomfs.db.Close()
+// log returns the logger configured for this instance.
+func (atomfs *Instance) log() types.Logger {
+	return atomfs.config.Log()
 }
 
-// FSCK does a filesystem check on this atomfs instance, returning any errors.
-func (atomfs *Instance) FSCK() ([]string, error) {
-	atoms, err := atomfs.db.GetAtoms()
-	if err != nil {
-		return nil, err
+// checkWritable returns ErrReadOnly if this instance can't be modified.
+func (atomfs *Instance) checkWritable() error {
+	if atomfs.config.ReadOnly {
+		return ErrReadOnly
 	}
+	return nil
+}
 
-	errs := []string{}
+// DumpDB() dumps the underlying sqlite3 db for inspection. If the Instance
+// has been closed, reading the dump fails with ErrClosed.
+func (atomfs *Instance) DumpDB() io.ReadCloser {
+	reader, writer := io.Pipe()
 
-	// TODO, we could do progress here.
-	for _, atom := range atoms {
-		f, err := os.Open(atomfs.config.AtomsPath(atom.Hash))
-		if err != nil {
-			// TODO: should check and see if this atom is used in
-			// any molecules, and if so delete those molecules,
-			// and if not at least delete it from the db.
-			errs = append(errs, err.Error())
-			continue
-		}
+	release, err := atomfs.acquire()
+	if err != nil {
+		writer.CloseWithError(err)
+		return reader
+	}
 
-		h := sha256.New()
-		_, err = io.Copy(h, f)
-		f.Close()
-		if err != nil {
-			errs = append(errs, err.Error())
-			continue
-		}
+	go func() {
+		defer release()
 
-		// Uh oh. Again, we should try to prune this, perhaps based on
-		// some "fix" parameter.
-		if fmt.Sprintf("%x", h.Sum(nil)) != atom.Hash {
-			errs = append(errs, fmt.Sprintf("%s does not match its hash", atom.Hash))
+		err := sqlite3dump.DumpMigration(atomfs.db.DB, writer)
+		if err != nil {
+			writer.CloseWithError(err)
+		} else {
+			writer.Close()
 		}
-	}
+	}()
 
-	return errs, nil
+	return reader
 }
 
-// GC does a garbage collection of atomfs, deleting any unused atoms, and any
-// files in the atom directory that aren't in the database.
-func (atomfs *Instance) GC(dryRun bool) error {
-	// First, let's prune unused atoms from the DB.
-	unusedAtoms, err := atomfs.db.GetUnusedAtoms()
-	if err != nil {
+// Vacuum shrinks the db file after lots of molecules or atoms have been
+// deleted. It takes the store's lock exclusively, and fails with an error
+// wrapping ErrLocked if that can't be done within Config.LockTimeout.
+func (atomfs *Instance) Vacuum() error {
+	if err := atomfs.checkWritable(); err != nil {
 		return err
 	}
 
-	if !dryRun {
-		for _, atom := range unusedAtoms {
-			if err := atomfs.db.DeleteThing(atom.ID, "atom"); err != nil {
-				return err
-			}
-		}
-	}
-
-	// Now, delete everything that's on disk that isn't in our DB.
-	onDiskAtoms, err := ioutil.ReadDir(atomfs.config.AtomsPath())
+	unlock, err := atomfs.lock(true)
 	if err != nil {
-		// It's possible that there may not have been any atoms
-		// imported yet. Don't fail in this case.
-		if os.IsNotExist(err) {
-			return nil
-		}
 		return err
 	}
+	defer unlock()
 
-	inDBAtoms, err := atomfs.db.GetAtoms()
+	return atomfs.db.Vacuum()
+}
+
+// BackupDB writes a consistent snapshot of the db (but not the atoms) to w. It
+// is safe to call while other operations are in progress.
+func (atomfs *Instance) BackupDB(w io.Writer) error {
+	release, err := atomfs.acquire()
 	if err != nil {
 		return err
 	}
+	defer release()
 
-	for _, onDiskAtom := range onDiskAtoms {
-		found := false
-		for _, inDBAtom := range inDBAtoms {
-			if onDiskAtom.Name() == inDBAtom.Hash {
-				found = true
-				break
-			}
-		}
-
-		if !found && !dryRun {
-			err := os.Remove(atomfs.config.AtomsPath(onDiskAtom.Name()))
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
+	return atomfs.db.Backup(w)
 }
 
-// DumpDB() dumps the underlying sqlite3 db for inspection.
-func (atomfs *Instance) DumpDB() io.ReadCloser {
-	reader, writer := io.Pipe()
+// DB returns the db that atomfs keeps its metadata in, for reading and writing
+// tables registered with types.ExternalSchema outside of a transaction. Use
+// Tx.Exec and friends to change them in the same transaction as molecules.
+// atomfs' own tables should be treated as read only; their layout may change
+// in any release.
+func (atomfs *Instance) DB() *sql.DB {
+	return atomfs.db.DB
+}
 
-	go func() {
-		err := sqlite3dump.DumpMigration(atomfs.db.DB, writer)
-		if err != nil {
-			writer.CloseWithError(err)
-		} else {
-			writer.Close()
-		}
-	}()
+// TempDir makes a new scratch directory in the store's directory, for
+// staging things made out of its atoms: being on the same filesystem as the
+// atoms, it lets e.g. ExportOCI link them rather than copy them. The caller
+// must remove it.
+func (atomfs *Instance) TempDir(prefix string) (string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
 
-	return reader
+	return ioutil.TempDir(atomfs.config.Path, prefix)
 }
@@ -1,8 +1,16 @@
 package atomfs
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash"
 	"io"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/anuvu/atomfs/db"
 	"github.com/anuvu/atomfs/types"
 	"github.com/openSUSE/umoci/oci/casext"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -10,16 +18,626 @@ import (
 )
 
 func (atomfs *Instance) GetAtoms() ([]types.Atom, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	return atomfs.db.GetAtoms()
 }
 
+// ListAtomsPage returns up to limit atoms, skipping the first offset. Atoms are
+// ordered by id, i.e. the order they were imported in.
+func (atomfs *Instance) ListAtomsPage(offset int, limit int) ([]types.Atom, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return atomfs.db.GetAtomsPage(offset, limit)
+}
+
+// CountAtoms returns the number of atoms in the store.
+func (atomfs *Instance) CountAtoms() (int, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	return atomfs.db.CountAtoms()
+}
+
+// ForEachAtom calls f with each atom in the store, without loading them all
+// into memory at once. If f returns an error, iteration stops and the error is
+// returned.
+func (atomfs *Instance) ForEachAtom(f func(types.Atom) error) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return atomfs.db.ForEachAtom(f)
+}
+
+// GetAtom looks up an atom by its hash; the bool return is false if there is
+// no such atom.
+func (atomfs *Instance) GetAtom(hash string) (types.Atom, bool, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Atom{}, false, err
+	}
+	defer release()
+
+	return atomfs.db.GetAtomByHash(hash)
+}
+
+// HasAtom reports whether the store has an atom with the given hash. It only
+// consults the db, so it is cheap, but it doesn't check that the atom's file
+// is intact; use VerifyAtom for that.
+func (atomfs *Instance) HasAtom(hash string) (bool, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	return atomfs.db.HasAtom(hash)
+}
+
 func (atomfs *Instance) CreateAtom(name string, atomType types.AtomType, content io.Reader) (types.Atom, error) {
-	return atomfs.db.CreateAtom(name, atomType, content)
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	opts := db.ImportOptions{Type: atomType, Verify: atomfs.verify}
+	return atomfs.db.CreateAtom(opts, name, content)
+}
+
+// ImportAtom stores the content of r as an atom named by its sha256. If an
+// atom with that content already exists, it is returned unchanged. The atom's
+// type is detected from its contents.
+func (atomfs *Instance) ImportAtom(r io.Reader) (types.Atom, error) {
+	return atomfs.ImportAtomWithAlgorithm(r, types.SHA256)
+}
+
+// ImportAtomWithAlgorithm is like ImportAtom, but names the atom by its hash
+// using the digest algorithm alg.
+func (atomfs *Instance) ImportAtomWithAlgorithm(r io.Reader, alg types.DigestAlgorithm) (types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	defer atomfs.observe(OpImportAtom, time.Now())
+
+	br := bufio.NewReader(r)
+	atom, err := atomfs.db.ImportAtom(atomfs.importOptions(alg, detectAtomType(br), br), br)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	atomfs.count(CounterImportedAtoms, 1)
+	return atom, nil
+}
+
+// ImportAtomWithMediaType is like ImportAtom, but records mediaType as the
+// atom's media type rather than guessing it. The atom's type is derived from
+// mediaType if it is a layer type atomfs knows, and detected otherwise.
+func (atomfs *Instance) ImportAtomWithMediaType(r io.Reader, mediaType string) (types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	defer atomfs.observe(OpImportAtom, time.Now())
+
+	br := bufio.NewReader(r)
+	atomType, err := atomTypeForMediaType(mediaType)
+	if err != nil {
+		atomType = detectAtomType(br)
+	}
+
+	opts := atomfs.importOptions(types.SHA256, atomType, br)
+	opts.MediaType = mediaType
+
+	atom, err := atomfs.db.ImportAtom(opts, br)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	atomfs.count(CounterImportedAtoms, 1)
+	return atom, nil
+}
+
+// ImportAtomExpecting is like ImportAtom, but fails with ErrDigestMismatch
+// (without storing anything) if the content's digest isn't expected. expected
+// may be a bare sha256 hash, or an "algorithm:hash" digest.
+func (atomfs *Instance) ImportAtomExpecting(r io.Reader, expected string) (types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	want := types.Digest{Algorithm: types.SHA256, Hash: expected}
+	if i := strings.Index(expected, ":"); i >= 0 {
+		want = types.Digest{Algorithm: types.DigestAlgorithm(expected[:i]), Hash: expected[i+1:]}
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	defer atomfs.observe(OpImportAtom, time.Now())
+
+	br := bufio.NewReader(r)
+	opts := atomfs.importOptions(want.Algorithm, detectAtomType(br), br)
+	opts.Verify = func(d types.Digest) error {
+		if d.Hash != want.Hash {
+			return fmt.Errorf("%w: expected %s, got %s", ErrDigestMismatch, want, d)
+		}
+		return atomfs.verify(d)
+	}
+
+	atom, err := atomfs.db.ImportAtom(opts, br)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	atomfs.count(CounterImportedAtoms, 1)
+	return atom, nil
+}
+
+// ImportAtomFromPath is like ImportAtom, but imports the file at path. Rather
+// than copying the file into the store, it is hardlinked if possible, so
+// importing a file on the same filesystem as the store is cheap; the file must
+// not be modified afterwards. Files imported this way are never compressed.
+// If the atom already exists, the existing one is returned.
+func (atomfs *Instance) ImportAtomFromPath(path string) (types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	br := bufio.NewReader(f)
+	atomType := detectAtomType(br)
+	mediaType := detectMediaType(atomType, br)
+	f.Close()
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	defer atomfs.observe(OpImportAtom, time.Now())
+
+	opts := db.ImportOptions{
+		Algorithm:   types.SHA256,
+		Compression: types.NoCompression,
+		Type:        atomType,
+		MediaType:   mediaType,
+		Verify:      atomfs.verify,
+	}
+
+	atom, err := atomfs.db.ImportAtomFile(opts, path)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	atomfs.count(CounterImportedAtoms, 1)
+	return atom, nil
+}
+
+// progressInterval is how many bytes ImportAtomWithProgress reads between
+// calls to its progress callback.
+const progressInterval = 1 << 20
+
+// ImportAtomWithProgress is like ImportAtom, but calls progress with the total
+// number of bytes read so far every progressInterval bytes, and once more when
+// r is exhausted.
+func (atomfs *Instance) ImportAtomWithProgress(r io.Reader, progress func(bytesRead int64)) (types.Atom, error) {
+	return atomfs.ImportAtom(&progressReader{r: r, progress: progress})
+}
+
+// progressReader is an io.Reader that reports how much of r has been read.
+type progressReader struct {
+	r        io.Reader
+	progress func(int64)
+	read     int64
+	reported int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+
+	if r.read-r.reported >= progressInterval || (err == io.EOF && r.read != r.reported) {
+		r.reported = r.read
+		r.progress(r.read)
+	}
+
+	return n, err
+}
+
+// detectAtomType peeks at the start of r to decide whether it is a squashfs
+// image; anything else is assumed to be a tarball.
+func detectAtomType(r *bufio.Reader) types.AtomType {
+	magic, err := r.Peek(4)
+	if err == nil && string(magic) == "hsqs" {
+		return types.SquashfsAtom
+	}
+
+	return types.TarAtom
 }
 
 func (atomfs *Instance) CreateAtomFromOCIBlob(blob *casext.Blob) (types.Atom, error) {
-	atomType := types.TarAtom
-	switch blob.Descriptor.MediaType {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	atomType, err := atomTypeForMediaType(blob.Descriptor.MediaType)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	opts := db.ImportOptions{Type: atomType, MediaType: blob.Descriptor.MediaType, Verify: atomfs.verify}
+	return atomfs.db.CreateAtom(opts, blob.Descriptor.Digest.Encoded(), blob.Data.(io.Reader))
+}
+
+// ImportAtoms is like ImportAtom, but imports all of readers at once, adding
+// them to the db in a single transaction at the end. If any of them fail, none
+// of them are added.
+func (atomfs *Instance) ImportAtoms(readers ...io.Reader) ([]types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	staged := []db.StagedAtom{}
+	for _, r := range readers {
+		br := bufio.NewReader(r)
+		s, err := atomfs.db.StageAtom(atomfs.importOptions(types.SHA256, detectAtomType(br), br), br)
+		if err != nil {
+			db.DiscardAtoms(staged)
+			return nil, err
+		}
+
+		staged = append(staged, s)
+	}
+
+	atoms, err := atomfs.db.CommitAtoms(staged)
+	if err != nil {
+		return nil, err
+	}
+
+	atomfs.count(CounterImportedAtoms, len(atoms))
+	return atoms, nil
+}
+
+// layerFetcher opens the content of the layer described by desc.
+type layerFetcher func(desc ispec.Descriptor) (io.ReadCloser, error)
+
+// ociLayoutLayers is a layerFetcher for the layers in an OCI layout.
+func ociLayoutLayers(oci casext.Engine) layerFetcher {
+	return func(desc ispec.Descriptor) (io.ReadCloser, error) {
+		layer, err := oci.FromDescriptor(context.Background(), desc)
+		if err != nil {
+			return nil, err
+		}
+
+		return &blobReader{layer.Data.(io.Reader), layer}, nil
+	}
+}
+
+// blobReader reads a casext.Blob's data, closing the blob when it is closed.
+type blobReader struct {
+	io.Reader
+	blob *casext.Blob
+}
+
+func (r *blobReader) Close() error {
+	return r.blob.Close()
+}
+
+// importOCILayers imports the layers described by descs as atoms, in order,
+// adding any new ones to the db in a single transaction. If an atom with a
+// layer's digest already exists, it is reused without fetching the layer at
+// all.
+func (atomfs *Instance) importOCILayers(fetch layerFetcher, descs []ispec.Descriptor) ([]types.Atom, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	atoms := make([]types.Atom, len(descs))
+	staged := []db.StagedAtom{}
+	stagedIdx := []int{}
+
+	for i, desc := range descs {
+		atom, ok, err := atomfs.db.GetAtomByHash(desc.Digest.Encoded())
+		if err != nil {
+			db.DiscardAtoms(staged)
+			return nil, err
+		}
+
+		if ok {
+			// Even though we have it, the layer still has to be
+			// trusted to be used in this image.
+			if err := atomfs.verify(atom.Digest()); err != nil {
+				db.DiscardAtoms(staged)
+				return nil, err
+			}
+
+			atoms[i] = atom
+			continue
+		}
+
+		s, err := atomfs.stageOCILayer(fetch, desc)
+		if err != nil {
+			db.DiscardAtoms(staged)
+			return nil, err
+		}
+
+		staged = append(staged, s)
+		stagedIdx = append(stagedIdx, i)
+	}
+
+	committed, err := atomfs.db.CommitAtoms(staged)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, atom := range committed {
+		atoms[stagedIdx[j]] = atom
+	}
+
+	return atoms, nil
+}
+
+// stageOCILayer writes the layer described by desc to a temp file, ready to
+// be committed as an atom. It fails with ErrDigestMismatch if the layer's
+// content doesn't match desc's digest.
+func (atomfs *Instance) stageOCILayer(fetch layerFetcher, desc ispec.Descriptor) (db.StagedAtom, error) {
+	atomType, err := atomTypeForMediaType(desc.MediaType)
+	if err != nil {
+		return db.StagedAtom{}, err
+	}
+
+	layer, err := fetch(desc)
+	if err != nil {
+		return db.StagedAtom{}, err
+	}
+	defer layer.Close()
+
+	alg := types.DigestAlgorithm(desc.Digest.Algorithm())
+	br := bufio.NewReader(layer)
+	opts := atomfs.importOptions(alg, atomType, br)
+	opts.MediaType = desc.MediaType
+	opts.Verify = func(d types.Digest) error {
+		if d.Hash != desc.Digest.Encoded() {
+			return fmt.Errorf("%w: expected %s, got %s", ErrDigestMismatch, desc.Digest, d)
+		}
+		return atomfs.verify(d)
+	}
+
+	return atomfs.db.StageAtom(opts, br)
+}
+
+// importOptions are the options for importing the content of r as an atom of
+// type atomType named with alg.
+func (atomfs *Instance) importOptions(alg types.DigestAlgorithm, atomType types.AtomType, r *bufio.Reader) db.ImportOptions {
+	return db.ImportOptions{
+		Algorithm:   alg,
+		Compression: atomfs.compressionFor(atomType, r),
+		Type:        atomType,
+		MediaType:   detectMediaType(atomType, r),
+		Verify:      atomfs.verify,
+	}
+}
+
+// detectMediaType guesses the media type of an atom of type atomType whose
+// content is r.
+func detectMediaType(atomType types.AtomType, r *bufio.Reader) string {
+	switch atomType {
+	case types.SquashfsAtom:
+		return mediaTypeLayerSquashfs
+	case types.TarAtom:
+		magic, err := r.Peek(2)
+		if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			return ispec.MediaTypeImageLayerGzip
+		}
+		return ispec.MediaTypeImageLayer
+	default:
+		return ""
+	}
+}
+
+// compressionFor decides how to compress an atom of type atomType whose
+// content is r. Only tar atoms are compressed: squashfs atoms have to stay as
+// they are so that the kernel can mount them, and tarballs that are already
+// gzipped wouldn't get any smaller. archivemount transparently decompresses
+// the tar atoms when they're mounted.
+func (atomfs *Instance) compressionFor(atomType types.AtomType, r *bufio.Reader) types.Compression {
+	if atomType != types.TarAtom {
+		return types.NoCompression
+	}
+
+	magic, err := r.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return types.NoCompression
+	}
+
+	if atomfs.config.Compression == "" {
+		return types.NoCompression
+	}
+
+	return atomfs.config.Compression
+}
+
+// OpenAtomByHash is OpenAtom for the atom with the given hash, which fails with
+// an error wrapping types.ErrAtomNotFound if there is no such atom, or
+// ErrAtomMissing if the atom's file is gone. However the atom is stored
+// (compressed, sharded or chunked), the reader returns its original content.
+func (atomfs *Instance) OpenAtomByHash(hash string) (io.ReadCloser, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	atom, ok, err := atomfs.db.GetAtomByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", types.ErrAtomNotFound, hash)
+	}
+
+	r, err := atomfs.OpenAtom(atom)
+	if os.IsNotExist(err) {
+		return nil, types.WrapError(ErrAtomMissing, hash, err)
+	}
+
+	return r, err
+}
+
+// OpenAtom returns a reader of the atom's uncompressed content. If
+// types.Config.VerifyOnRead is set, the content is hashed as it is read, and
+// reading its end fails with an error wrapping ErrAtomCorrupt if it doesn't
+// match the atom's hash. Opening an atom records that it was used, for
+// GCToSize, so it shouldn't be called while iterating with ForEachAtom.
+func (atomfs *Instance) OpenAtom(atom types.Atom) (io.ReadCloser, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	r, err := atomfs.openAtom(atom)
+	if err != nil {
+		return nil, err
+	}
+
+	if !atomfs.config.ReadOnly {
+		if err := atomfs.db.TouchAtoms([]types.Atom{atom}); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	if !atomfs.config.VerifyOnRead {
+		return r, nil
+	}
+
+	h, err := atom.Algorithm.New()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return &verifyingReader{r, h, atom.Hash}, nil
+}
+
+// openAtom is OpenAtom without any VerifyOnRead checking, for callers that
+// check the content themselves.
+func (atomfs *Instance) openAtom(atom types.Atom) (io.ReadCloser, error) {
+	if atom.Chunked {
+		return atomfs.openChunkedAtom(atom)
+	}
+
+	f, err := atomfs.storage.Open(atom.FileName())
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := atomfs.db.DecryptReader(atom, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r, err := atom.Compression.NewReader(plain)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &atomReader{r, f}, nil
+}
+
+// atomReader reads an atom's decompressed content, closing both the
+// decompressor and the underlying object when it is closed.
+type atomReader struct {
+	io.ReadCloser
+	f io.Closer
+}
+
+func (r *atomReader) Close() error {
+	err := r.ReadCloser.Close()
+	if err2 := r.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// verifyingReader hashes the content read through it, and fails with an error
+// wrapping ErrAtomCorrupt at the end of it if it doesn't match hash.
+type verifyingReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	hash string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := fmt.Sprintf("%x", r.h.Sum(nil)); actual != r.hash {
+			return n, fmt.Errorf("%w: %s does not match its hash", ErrAtomCorrupt, r.hash)
+		}
+	}
+	return n, err
+}
+
+func atomTypeForMediaType(mediaType string) (types.AtomType, error) {
+	switch mediaType {
 	case ispec.MediaTypeImageLayer:
 		fallthrough
 	case ispec.MediaTypeImageLayerGzip:
@@ -27,15 +645,17 @@ func (atomfs *Instance) CreateAtomFromOCIBlob(blob *casext.Blob) (types.Atom, er
 	case ispec.MediaTypeImageLayerNonDistributable:
 		fallthrough
 	case ispec.MediaTypeImageLayerNonDistributableGzip:
-		atomType = types.TarAtom
+		return types.TarAtom, nil
+	case mediaTypeDockerLayer:
+		fallthrough
+	case mediaTypeDockerForeignLayer:
+		return types.TarAtom, nil
 	// stolen from stacker:base.go
-	case "application/vnd.oci.image.layer.squashfs":
-		atomType = types.SquashfsAtom
+	case mediaTypeLayerSquashfs:
+		return types.SquashfsAtom, nil
 	default:
-		return types.Atom{}, errors.Errorf("unknown media type: %s", blob.Descriptor.MediaType)
+		return "", errors.Errorf("unknown media type: %s", mediaType)
 	}
-
-	return atomfs.db.CreateAtom(blob.Descriptor.Digest.Encoded(), atomType, blob.Data.(io.Reader))
 }
 
 func (atomfs *Instance) GetAtomsByHash() (map[string]types.Atom, error) {
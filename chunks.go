@@ -0,0 +1,174 @@
+package atomfs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// ImportAtomChunked is like ImportAtom, but stores the atom as content defined
+// chunks (see types.Atom.Chunked), so that atoms which are mostly the same
+// share most of their storage. This only helps for content that isn't
+// compressed, since a small change to the input of a compressor changes all
+// of its output after that point. Chunked atoms are reassembled into a whole
+// file while they are mounted or exported, which GC removes afterwards.
+func (atomfs *Instance) ImportAtomChunked(r io.Reader) (types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Atom{}, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer unlock()
+
+	defer atomfs.observe(OpImportAtom, time.Now())
+
+	br := bufio.NewReader(r)
+	opts := atomfs.importOptions(types.SHA256, detectAtomType(br), br)
+	atom, err := atomfs.db.ImportChunkedAtom(opts, br)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	atomfs.count(CounterImportedAtoms, 1)
+	return atom, nil
+}
+
+// openChunkedAtom returns a reader of a chunked atom's content, which fails
+// with an error wrapping ErrAtomCorrupt if any chunk doesn't match its hash.
+func (atomfs *Instance) openChunkedAtom(atom types.Atom) (io.ReadCloser, error) {
+	chunks, err := atomfs.db.GetAtomChunks(atom.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkReader{atomfs: atomfs, chunks: chunks}, nil
+}
+
+// chunkReader reads a sequence of chunks, checking each one's hash as it
+// reaches the end of it.
+type chunkReader struct {
+	atomfs *Instance
+	chunks []types.Chunk
+	cur    io.ReadCloser
+	h      hash.Hash
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			f, err := r.atomfs.storage.Open(r.chunks[0].FileName())
+			if err != nil {
+				return 0, err
+			}
+
+			r.cur = f
+			r.h = sha256.New()
+		}
+
+		n, err := r.cur.Read(p)
+		r.h.Write(p[:n])
+		if err == io.EOF {
+			chunk := r.chunks[0]
+			r.cur.Close()
+			r.cur = nil
+			r.chunks = r.chunks[1:]
+
+			if actual := fmt.Sprintf("%x", r.h.Sum(nil)); actual != chunk.Hash {
+				return n, fmt.Errorf("%w: chunk %s does not match its hash", ErrAtomCorrupt, chunk.Hash)
+			}
+
+			err = nil
+		}
+
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+
+	return r.cur.Close()
+}
+
+// reassembleAtoms writes the files of any of atoms that are chunked and don't
+// have them, so that they can be mounted or exported.
+func (atomfs *Instance) reassembleAtoms(atoms []types.Atom) error {
+	for _, atom := range atoms {
+		if !atom.Chunked {
+			continue
+		}
+
+		if _, err := atomfs.storage.Stat(atom.FileName()); err == nil {
+			continue
+		}
+
+		if err := atomfs.checkWritable(); err != nil {
+			return fmt.Errorf("couldn't reassemble chunked atom %s: %w", atom.Hash, err)
+		}
+
+		if err := atomfs.reassembleAtom(atom); err != nil {
+			return fmt.Errorf("couldn't reassemble chunked atom %s: %w", atom.Hash, err)
+		}
+	}
+
+	return nil
+}
+
+func (atomfs *Instance) reassembleAtom(atom types.Atom) error {
+	in, err := atomfs.openChunkedAtom(atom)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w, err := atomfs.storage.Create()
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, in); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Commit(atom.FileName())
+}
+
+// missingChunks returns the hashes of the atom's chunks whose files don't
+// exist.
+func (atomfs *Instance) missingChunks(atom types.Atom) ([]string, error) {
+	chunks, err := atomfs.db.GetAtomChunks(atom.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []string{}
+	for _, chunk := range chunks {
+		_, err := atomfs.storage.Stat(chunk.FileName())
+		if errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, chunk.Hash)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
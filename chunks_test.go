@@ -0,0 +1,107 @@
+package atomfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func readAtom(t *testing.T, atomfs *Instance, atom types.Atom) []byte {
+	r, err := atomfs.OpenAtom(atom)
+	if err != nil {
+		t.Fatalf("couldn't open atom %s", err)
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("couldn't read atom %s", err)
+	}
+
+	return content
+}
+
+func TestChunkedAtomRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-chunks-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	content := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	atom, err := atomfs.ImportAtomChunked(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("couldn't import chunked atom %s", err)
+	}
+
+	if !atom.Chunked {
+		t.Fatalf("atom isn't chunked")
+	}
+
+	if !bytes.Equal(readAtom(t, atomfs, atom), content) {
+		t.Fatalf("chunked atom's content changed")
+	}
+}
+
+func TestGCKeepsSharedChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-chunks-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	base := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(base)
+	extended := append(append([]byte{}, base...), []byte("some more")...)
+
+	first, err := atomfs.ImportAtomChunked(bytes.NewReader(base))
+	if err != nil {
+		t.Fatalf("couldn't import chunked atom %s", err)
+	}
+
+	second, err := atomfs.ImportAtomChunked(bytes.NewReader(extended))
+	if err != nil {
+		t.Fatalf("couldn't import chunked atom %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("first", []types.Atom{first}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("second", []types.Atom{second}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if err := atomfs.DeleteMolecule("first"); err != nil {
+		t.Fatalf("couldn't delete molecule %s", err)
+	}
+
+	report, err := atomfs.GCReport(false)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(report.PrunedAtoms) != 1 || report.PrunedAtoms[0].Hash != first.Hash {
+		t.Fatalf("expected only the first atom to be pruned, got %v", report.PrunedAtoms)
+	}
+
+	if !bytes.Equal(readAtom(t, atomfs, second), extended) {
+		t.Fatalf("gc broke the chunks of an atom that is still used")
+	}
+}
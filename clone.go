@@ -0,0 +1,114 @@
+package atomfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/anuvu/atomfs/storage"
+	"github.com/anuvu/atomfs/types"
+)
+
+// Clone copies this store to a new store at destPath, which must not already
+// contain one. Atom files are hardlinked where possible and copied otherwise.
+// It is safe to call while the store is in use; the clone has everything that
+// was in the db when Clone started.
+//
+// The clone's db is only put into place once all of its atoms have been
+// copied, so an interrupted Clone never leaves a db that references missing
+// atoms (though it may leave atom files behind, which GC will clean up).
+func (atomfs *Instance) Clone(destPath string) error {
+	// Check destPath before making any directories in it.
+	dest := types.Config{Path: destPath, ShardLevels: atomfs.config.ShardLevels}
+	if err := dest.Validate(); err != nil {
+		return err
+	}
+
+	dbPath := dest.RelativePath("atomfs.db")
+	if _, err := os.Stat(dbPath); err == nil {
+		return fmt.Errorf("%s already contains an atomfs store", destPath)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if _, err := types.NewConfig(destPath); err != nil {
+		return err
+	}
+
+	// Atoms are only ever deleted with the lock held exclusively, so while
+	// we hold it shared, every atom in the snapshot stays on disk.
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tmp := dest.RelativePath(storage.TempPrefix + "atomfs.db")
+	os.Remove(tmp)
+	if err := atomfs.db.CloneTo(tmp); err != nil {
+		return err
+	}
+
+	// Atoms can still be added after the snapshot, so this may copy a few
+	// that the clone doesn't need, but it can't miss any that it does.
+	atoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	destStorage := storage.NewShardedLocal(dest.AtomsPath(), dest.ShardLevels)
+	dirs := map[string]bool{}
+	for _, atom := range atoms {
+		files := []string{atom.FileName()}
+		if atom.Chunked {
+			chunks, err := atomfs.db.GetAtomChunks(atom.ID)
+			if err != nil {
+				os.Remove(tmp)
+				return err
+			}
+
+			files = []string{}
+			for _, chunk := range chunks {
+				files = append(files, chunk.FileName())
+			}
+		}
+
+		for _, name := range files {
+			target := destStorage.CanonicalPath(name)
+			if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+
+			if err := atomfs.linkOrCopy(name, target); err != nil {
+				os.Remove(tmp)
+				return fmt.Errorf("couldn't copy atom %s: %w", atom.Hash, err)
+			}
+
+			if err := storage.SyncFile(target); err != nil {
+				os.Remove(tmp)
+				return err
+			}
+
+			for dir := path.Dir(target); dir != path.Dir(path.Clean(destPath)); dir = path.Dir(dir) {
+				dirs[dir] = true
+			}
+		}
+	}
+
+	// Make sure that the atoms (and the directories they're in) are on
+	// disk before the db that references them is.
+	for dir := range dirs {
+		if err := storage.SyncFile(dir); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return err
+	}
+
+	return storage.SyncFile(path.Dir(dbPath))
+}
@@ -0,0 +1,110 @@
+package atomfs
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestClone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-clone-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: path.Join(dir, "src")})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+	defer atomfs.Close()
+
+	plain, err := atomfs.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	content := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	chunked, err := atomfs.ImportAtomChunked(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("couldn't import chunked atom %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("both", []types.Atom{chunked, plain}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	destPath := path.Join(dir, "dest")
+	if err := atomfs.Clone(destPath); err != nil {
+		t.Fatalf("couldn't clone %s", err)
+	}
+
+	// A store can only be cloned into somewhere that doesn't have one.
+	if err := atomfs.Clone(destPath); err == nil {
+		t.Fatalf("cloned over an existing store")
+	}
+
+	clone, err := New(types.Config{Path: destPath})
+	if err != nil {
+		t.Fatalf("couldn't open clone %s", err)
+	}
+	defer clone.Close()
+
+	mol, err := clone.GetMolecule("both")
+	if err != nil {
+		t.Fatalf("couldn't get molecule %s", err)
+	}
+
+	if len(mol.Atoms) != 2 {
+		t.Fatalf("cloned molecule has the wrong atoms %v", mol.Atoms)
+	}
+
+	if !bytes.Equal(readAtom(t, clone, mol.Atoms[0]), content) {
+		t.Fatalf("chunked atom's content changed in the clone")
+	}
+
+	if string(readAtom(t, clone, mol.Atoms[1])) != "foo" {
+		t.Fatalf("atom's content changed in the clone")
+	}
+
+	results, err := clone.FSCK()
+	if err != nil {
+		t.Fatalf("couldn't fsck clone %s", err)
+	}
+
+	if len(results) != 0 {
+		t.Fatalf("fsck of the clone found %v", results)
+	}
+}
+
+func TestCloneInvalidDest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-clone-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+	defer atomfs.Close()
+
+	// Relative paths aren't valid for a store.
+	if err := atomfs.Clone("atomfs-clone-relative"); !errors.Is(err, types.ErrInvalidConfig) {
+		t.Fatalf("bad error cloning to a relative path: %v", err)
+	}
+
+	if _, err := os.Stat("atomfs-clone-relative"); !os.IsNotExist(err) {
+		os.RemoveAll("atomfs-clone-relative")
+		t.Fatalf("invalid clone made directories: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/anuvu/atomfs"
+	"github.com/urfave/cli"
+)
+
+var exportOCICmd = cli.Command{
+	Name:   "export-oci",
+	Usage:  "export an atomfs molecule as an OCI image",
+	Action: doExportOCI,
+	ArgsUsage: `<molecule> <oci-dir>
+
+Export the molecule to the OCI directory, tagged with the molecule's name. Note
+that this copies (or hardlinks, if possible) the atoms to the OCI directory.
+`,
+}
+
+func doExportOCI(ctx *cli.Context) error {
+	config, err := getAtomfsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	fs, err := atomfs.New(config)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	return fs.ExportOCI(ctx.Args().Get(0), ctx.Args().Get(1))
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
 
 	"github.com/anuvu/atomfs"
 	"github.com/urfave/cli"
@@ -11,6 +13,37 @@ var fsckCmd = cli.Command{
 	Name:   "fsck",
 	Usage:  "checks an atomfs filesystem for consistency",
 	Action: doFSCK,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "progress",
+			Usage: "print progress to stderr as atoms are checked",
+		},
+		cli.IntFlag{
+			Name:  "workers",
+			Usage: "the number of atoms to check in parallel",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "quick",
+			Usage: "only check that atoms exist and are the right size, without reading them",
+		},
+		cli.BoolFlag{
+			Name:  "presence-only",
+			Usage: "only check that atoms exist, trusting the filesystem to keep them intact",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "skip atoms that haven't changed since a previous --resume run checked them",
+		},
+		cli.BoolFlag{
+			Name:  "fix",
+			Usage: "prune bad atoms and any molecules that use them",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "with --fix, print what would be pruned without deleting anything",
+		},
+	},
 }
 
 func doFSCK(ctx *cli.Context) error {
@@ -24,11 +57,61 @@ func doFSCK(ctx *cli.Context) error {
 		return err
 	}
 	defer fs.Close()
-	errs, err := fs.FSCK()
+
+	if ctx.Bool("fix") {
+		return doFSCKFix(fs, ctx.Bool("dry-run"))
+	}
+
+	var progress func(int, int, string)
+	if ctx.Bool("progress") {
+		progress = func(done, total int, hash string) {
+			fmt.Fprintf(os.Stderr, "[%d/%d] checking %s\n", done+1, total, hash)
+		}
+	}
+
+	if ctx.Bool("presence-only") {
+		errs, err := fs.FSCKPresenceOnly()
+		if err != nil {
+			return err
+		}
+
+		return printFSCKErrors(errs)
+	}
+
+	var errs []string
+	if ctx.Bool("quick") || ctx.Bool("resume") {
+		var results []atomfs.FSCKResult
+		if ctx.Bool("quick") {
+			results, err = fs.FSCKQuick()
+		} else {
+			results, err = fs.FSCKResume(context.Background())
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, r := range results {
+			errs = append(errs, r.String())
+		}
+	} else if workers := ctx.Int("workers"); workers > 1 {
+		errs, err = fs.FSCKParallel(workers)
+	} else {
+		errs, err = fs.FSCKWithProgress(progress)
+	}
+	if err != nil {
+		return err
+	}
+
+	refErrs, err := fs.FSCKReferences()
 	if err != nil {
 		return err
 	}
+	errs = append(errs, refErrs...)
+
+	return printFSCKErrors(errs)
+}
 
+func printFSCKErrors(errs []string) error {
 	for _, anErr := range errs {
 		fmt.Println(anErr)
 	}
@@ -40,3 +123,30 @@ func doFSCK(ctx *cli.Context) error {
 	fmt.Println("fsck ok.")
 	return nil
 }
+
+func doFSCKFix(fs *atomfs.Instance, dryRun bool) error {
+	repaired, errs, err := fs.FSCKFix(dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, anErr := range errs {
+		fmt.Println(anErr)
+	}
+
+	for _, r := range repaired {
+		fmt.Println(r)
+	}
+
+	if len(errs) == 0 {
+		fmt.Println("fsck ok.")
+		return nil
+	}
+
+	if dryRun {
+		return fmt.Errorf("fsck failed.")
+	}
+
+	fmt.Printf("fsck found %d problems, and made %d repairs.\n", len(errs), len(repaired))
+	return nil
+}
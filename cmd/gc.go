@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/anuvu/atomfs"
 	"github.com/urfave/cli"
 )
@@ -13,6 +15,10 @@ var gcCmd = cli.Command{
 			Name:  "dry-run",
 			Usage: "do a dry run of a GC, without actually deleting anything",
 		},
+		cli.BoolFlag{
+			Name:  "empty-molecules",
+			Usage: "also delete molecules that have no atoms",
+		},
 	},
 	Action: doGC,
 }
@@ -28,5 +34,33 @@ func doGC(ctx *cli.Context) error {
 		return err
 	}
 	defer fs.Close()
-	return fs.GC(ctx.Bool("dry-run"))
+
+	report, err := fs.GCWithOptions(atomfs.GCOptions{
+		DryRun:         ctx.Bool("dry-run"),
+		EmptyMolecules: ctx.Bool("empty-molecules"),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, atom := range report.SkippedAtoms {
+		fmt.Printf("skipped atom %s (%s) (in use)\n", atom.Name, atom.Hash)
+	}
+
+	if ctx.Bool("dry-run") {
+		for _, mol := range report.EmptyMolecules {
+			fmt.Printf("would delete empty molecule %s\n", mol.Name)
+		}
+		for _, atom := range report.PrunedAtoms {
+			fmt.Printf("would prune atom %s (%s)\n", atom.Name, atom.Hash)
+		}
+		for _, f := range report.OrphanedFiles {
+			fmt.Printf("would remove orphaned file %s\n", f)
+		}
+		for _, f := range report.TempFiles {
+			fmt.Printf("would remove temp file %s\n", f)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/atomfs"
+	"github.com/urfave/cli"
+)
+
+var lsCmd = cli.Command{
+	Name:   "ls",
+	Usage:  "lists the molecules in an atomfs",
+	Action: doLs,
+}
+
+func doLs(ctx *cli.Context) error {
+	config, err := getAtomfsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	fs, err := atomfs.New(config)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	mols, err := fs.ListMolecules()
+	if err != nil {
+		return err
+	}
+
+	for _, mol := range mols {
+		fmt.Printf("%s\t%d atoms\n", mol.Name, len(mol.Atoms))
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/anuvu/atomfs/types"
 	"github.com/urfave/cli"
@@ -14,7 +15,19 @@ var (
 )
 
 func getAtomfsConfig(ctx *cli.Context) (types.Config, error) {
-	return types.NewConfig(ctx.GlobalString("base-dir"))
+	baseDir, err := filepath.Abs(ctx.GlobalString("base-dir"))
+	if err != nil {
+		return types.Config{}, err
+	}
+
+	config, err := types.NewConfig(baseDir)
+	if err != nil {
+		return types.Config{}, err
+	}
+
+	config.Compression = types.Compression(ctx.GlobalString("compression"))
+	config.ShardLevels = ctx.GlobalInt("shard-levels")
+	return config, nil
 }
 
 func main() {
@@ -24,6 +37,11 @@ func main() {
 	app.Version = version
 	app.Commands = []cli.Command{
 		slurpOCICmd,
+		pullCmd,
+		pushCmd,
+		exportOCICmd,
+		lsCmd,
+		statsCmd,
 		mountCmd,
 		umountCmd,
 		fsckCmd,
@@ -38,6 +56,15 @@ func main() {
 			Usage: "the base atomfs dir for managing data",
 			Value: "/var/lib/atomfs",
 		},
+		cli.StringFlag{
+			Name:  "compression",
+			Usage: "how to compress newly imported atoms on disk (none, gzip or zstd)",
+			Value: "none",
+		},
+		cli.IntFlag{
+			Name:  "shard-levels",
+			Usage: "how many levels of subdirectories to shard the atoms directory into",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "print stack traces on exceptions",
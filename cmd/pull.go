@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/anuvu/atomfs"
+	"github.com/urfave/cli"
+)
+
+var pullCmd = cli.Command{
+	Name:   "pull",
+	Usage:  "pull an image from a registry into atomfs",
+	Action: doPull,
+	ArgsUsage: `<image> <molecule>
+
+Pull the image (e.g. docker.io/library/alpine:3.9) from its registry and import
+it as a molecule. Layers that atomfs already has aren't downloaded again.
+`,
+}
+
+func doPull(ctx *cli.Context) error {
+	config, err := getAtomfsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	fs, err := atomfs.New(config)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	_, err = fs.PullImage(ctx.Args().Get(0), ctx.Args().Get(1))
+	return err
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/anuvu/atomfs"
+	"github.com/anuvu/atomfs/push"
+	"github.com/urfave/cli"
+)
+
+var pushCmd = cli.Command{
+	Name:   "push",
+	Usage:  "push a molecule to a registry",
+	Action: doPush,
+	ArgsUsage: `<molecule> <image>
+
+Push the molecule to a registry as the image (e.g. registry.example.com/foo:1).
+Layers that the registry already has aren't uploaded again.
+`,
+}
+
+func doPush(ctx *cli.Context) error {
+	config, err := getAtomfsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	fs, err := atomfs.New(config)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	return push.Molecule(fs, ctx.Args().Get(0), ctx.Args().Get(1))
+}
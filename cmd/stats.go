@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/atomfs"
+	"github.com/urfave/cli"
+)
+
+var statsCmd = cli.Command{
+	Name:   "stats",
+	Usage:  "prints some metrics about an atomfs",
+	Action: doStats,
+}
+
+func doStats(ctx *cli.Context) error {
+	config, err := getAtomfsConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	fs, err := atomfs.New(config)
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+
+	stats, err := fs.Stats()
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(atomfs.FormatStats(stats))
+	return nil
+}
@@ -1,82 +1,542 @@
 package db
 
 import (
-	"crypto/sha256"
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"time"
 
+	"github.com/anuvu/atomfs/storage"
 	"github.com/anuvu/atomfs/types"
 )
 
+// atomColumns are the columns of the atoms table that getAtoms() expects, in
+// order.
+const atomColumns = "atoms.id, atoms.name, atoms.hash, atoms.type, atoms.algorithm, atoms.compression, atoms.size, atoms.chunked, atoms.media_type, atoms.key_id, atoms.pinned"
+
 type AtomfsDB struct {
 	// Expose the DB; although nobody should use it because the helper
 	// methods should be ok, you never know...
-	DB     *sql.DB
-	config types.Config
+	DB      *sql.DB
+	config  types.Config
+	storage storage.Storage
+
+	// q is what queries are run against: either DB, or tx if this
+	// AtomfsDB is a transaction (see Begin()).
+	q  querier
+	tx *sql.Tx
+	// snapshot is the connection that q runs on if this AtomfsDB is a
+	// snapshot (see Snapshot()).
+	snapshot *sql.Conn
 }
 
 func New(config types.Config) (*AtomfsDB, error) {
-	db, err := openSqlite(config.RelativePath("atomfs.db"))
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	open := openSqlite
+	if config.ReadOnly {
+		open = openSqliteReadOnly
+	}
+
+	db, err := open(config.RelativePath("atomfs.db"), config.SQLite)
 	if err != nil {
 		return nil, err
 	}
 
-	return &AtomfsDB{db, config}, nil
+	check := migrateExternal
+	if config.ReadOnly {
+		check = checkExternal
+	}
+
+	if err := check(db, config.ExternalSchemas); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &AtomfsDB{DB: db, config: config, storage: config.AtomStorage(), q: errQuerier{db}}, nil
 }
 
 func (db *AtomfsDB) Close() error {
 	return db.DB.Close()
 }
 
-func (db *AtomfsDB) CreateAtom(name string, atomType types.AtomType, content io.Reader) (types.Atom, error) {
-	f, err := ioutil.TempFile(db.config.AtomsPath(), "create-atom-")
+// writeTempAtom streams content to a new object in the atom storage,
+// compressing it with compression and then encrypting it if the config has an
+// Encrypter, and returns the uncommitted object and the hash of the
+// uncompressed content.
+func (db *AtomfsDB) writeTempAtom(alg types.DigestAlgorithm, compression types.Compression, content io.Reader) (storage.Writer, string, error) {
+	h, err := alg.New()
 	if err != nil {
-		return types.Atom{}, err
+		return nil, "", err
 	}
-	defer f.Close()
 
-	h := sha256.New()
-	w := io.MultiWriter(h, f)
+	f, err := db.storage.Create()
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't create atom file: %w", err)
+	}
+
+	ew, err := db.encryptWriter(f)
+	if err != nil {
+		f.Abort()
+		return nil, "", err
+	}
+
+	cw, err := compression.NewWriter(ew)
+	if err != nil {
+		f.Abort()
+		return nil, "", err
+	}
+
+	w := io.MultiWriter(h, cw)
 
 	_, err = io.Copy(w, content)
+	if err == nil {
+		err = cw.Close()
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		f.Abort()
+		return nil, "", err
+	}
+
+	return f, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// nopWriteCloser is an io.WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// encryptWriter returns a writer that encrypts what is written to it with the
+// config's Encrypter, if it has one, and writes the result to w.
+func (db *AtomfsDB) encryptWriter(w io.Writer) (io.WriteCloser, error) {
+	if db.config.Encrypter == nil {
+		return nopWriteCloser{w}, nil
+	}
+
+	return db.config.Encrypter.Encrypt(w)
+}
+
+// keyID is the types.Atom.KeyID of atoms written by writeTempAtom.
+func (db *AtomfsDB) keyID() string {
+	if db.config.Encrypter == nil {
+		return ""
+	}
+
+	return db.config.Encrypter.KeyID()
+}
+
+// DecryptReader returns a reader of the plaintext of r, the content of atom's
+// file, which is just r if the atom isn't encrypted.
+func (db *AtomfsDB) DecryptReader(atom types.Atom, r io.Reader) (io.Reader, error) {
+	if atom.KeyID == "" {
+		return r, nil
+	}
+
+	if db.config.Encrypter == nil {
+		return nil, fmt.Errorf("atom %s is encrypted, but there is no Encrypter to decrypt it", atom.Hash)
+	}
+
+	return db.config.Encrypter.Decrypt(atom.KeyID, r)
+}
+
+// RekeyAtom rewrites atom's file encrypted with the Encrypter's current key
+// (or in the clear, if there is no Encrypter), and records that in the db. The
+// new file has a different name (see types.Atom.FileName), so the old one is
+// only removed once the db refers to the new one; if this is interrupted, the
+// atom is left as it was, plus a file for GC to remove.
+func (db *AtomfsDB) RekeyAtom(atom types.Atom) (types.Atom, error) {
+	if atom.Chunked {
+		return types.Atom{}, fmt.Errorf("chunked atom %s can't be encrypted", atom.Hash)
+	}
+
+	in, err := db.storage.Open(atom.FileName())
+	if err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't open atom %s: %w", atom.Hash, err)
+	}
+	defer in.Close()
+
+	plain, err := db.DecryptReader(atom, in)
 	if err != nil {
 		return types.Atom{}, err
 	}
 
-	hash := fmt.Sprintf("%x", h.Sum(nil))
-	f.Close()
-	err = os.Rename(f.Name(), db.config.AtomsPath(hash))
+	w, err := db.storage.Create()
 	if err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't create atom file: %w", err)
+	}
+
+	ew, err := db.encryptWriter(w)
+	if err != nil {
+		w.Abort()
+		return types.Atom{}, err
+	}
+
+	_, err = io.Copy(ew, plain)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return types.Atom{}, err
+	}
+
+	rekeyed := atom
+	rekeyed.KeyID = db.keyID()
+	if err := w.Commit(rekeyed.FileName()); err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't commit atom %s: %w", atom.Hash, err)
+	}
+
+	fi, err := db.storage.Stat(rekeyed.FileName())
+	if err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't stat atom %s: %w", atom.Hash, err)
+	}
+
+	rekeyed.Size = fi.Size
+	rekeyed.SizeKnown = true
+	keyID := sql.NullString{String: rekeyed.KeyID, Valid: rekeyed.KeyID != ""}
+	_, err = db.q.Exec("UPDATE atoms SET key_id = ?, size = ? WHERE id = ?", keyID, rekeyed.Size, rekeyed.ID)
+	if err != nil {
+		db.storage.Remove(rekeyed.FileName())
 		return types.Atom{}, err
 	}
 
-	stmt, err := db.DB.Prepare("INSERT INTO atoms (name, hash, type) VALUES (?, ?, ?)")
+	// The atom has been rekeyed either way; if its old file can't be
+	// removed, it is an orphan that GC will remove.
+	db.storage.Remove(atom.FileName())
+
+	return rekeyed, nil
+}
+
+// insertAtom adds an atom whose file has already been committed to the db.
+func (db *AtomfsDB) insertAtom(atom types.Atom) (types.Atom, error) {
+	fi, err := db.storage.Stat(atom.FileName())
+	if err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't stat atom %s: %w", atom.Hash, err)
+	}
+	atom.Size = fi.Size
+	atom.SizeKnown = true
+
+	return db.insertAtomRow(atom)
+}
+
+// insertAtomRow adds atom to the atoms table as it is.
+func (db *AtomfsDB) insertAtomRow(atom types.Atom) (types.Atom, error) {
+	stmt, err := db.q.Prepare("INSERT INTO atoms (name, hash, type, algorithm, compression, last_used, size, chunked, media_type, key_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return types.Atom{}, err
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(name, hash, atomType)
+	atom.Algorithm = atom.Digest().Algorithm
+	if atom.Compression == "" {
+		atom.Compression = types.NoCompression
+	}
+
+	keyID := sql.NullString{String: atom.KeyID, Valid: atom.KeyID != ""}
+	size := sql.NullInt64{Int64: atom.Size, Valid: atom.SizeKnown}
+	result, err := stmt.Exec(atom.Name, atom.Hash, atom.Type, atom.Algorithm, atom.Compression, time.Now().UTC(), size, atom.Chunked, atom.MediaType, keyID)
+	if err != nil {
+		return types.Atom{}, wrapDBError(err)
+	}
+
+	atom.ID, err = result.LastInsertId()
 	if err != nil {
 		return types.Atom{}, err
 	}
 
-	id, err := result.LastInsertId()
+	return atom, nil
+}
+
+// CreateAtom stores content as an uncompressed sha256 atom called name. Of
+// opts, only Type, MediaType and Verify are used.
+func (db *AtomfsDB) CreateAtom(opts ImportOptions, name string, content io.Reader) (types.Atom, error) {
+	if err := db.checkQuota(); err != nil {
+		return types.Atom{}, err
+	}
+
+	w, hash, err := db.writeTempAtom(types.SHA256, types.NoCompression, content)
 	if err != nil {
 		return types.Atom{}, err
 	}
 
-	return types.Atom{id, name, hash, atomType}, nil
+	if opts.Verify != nil {
+		if err := opts.Verify(types.Digest{Algorithm: types.SHA256, Hash: hash}); err != nil {
+			w.Abort()
+			return types.Atom{}, err
+		}
+	}
+
+	atom := types.Atom{Name: name, Hash: hash, Type: opts.Type, Algorithm: types.SHA256, MediaType: opts.MediaType, KeyID: db.keyID()}
+	if err := w.Commit(atom.FileName()); err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't commit atom %s: %w", atom.Hash, err)
+	}
+
+	return db.insertAtom(atom)
+}
+
+// ImportOptions control how ImportAtom stores an atom.
+type ImportOptions struct {
+	// Algorithm is the digest algorithm the atom is named with.
+	Algorithm types.DigestAlgorithm
+	// Compression is how the atom is compressed on disk.
+	Compression types.Compression
+	Type        types.AtomType
+	// MediaType is recorded as the atom's types.Atom.MediaType.
+	MediaType string
+	// Verify, if non-nil, is called with the digest of the atom's content
+	// before it is stored; if it returns an error, the atom is discarded
+	// and the error is returned.
+	Verify func(types.Digest) error
+}
+
+// ImportAtom content-addresses content into the store, using its hash as the
+// atom's name. If an atom with the same hash already exists, it is returned
+// and the existing file is left alone.
+func (db *AtomfsDB) ImportAtom(opts ImportOptions, content io.Reader) (types.Atom, error) {
+	staged, err := db.StageAtom(opts, content)
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	atoms, err := db.CommitAtoms([]StagedAtom{staged})
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	return atoms[0], nil
+}
+
+// ImportAtomFile is like ImportAtom, but imports the file at src. If the atom
+// storage is local and the atom isn't compressed or encrypted, the file is
+// hardlinked into it (falling back to a copy) rather than being streamed
+// through, and the link is what is hashed.
+func (db *AtomfsDB) ImportAtomFile(opts ImportOptions, src string) (types.Atom, error) {
+	local, ok := db.storage.(*storage.Local)
+	if !ok || (opts.Compression != "" && opts.Compression != types.NoCompression) || db.config.Encrypter != nil {
+		f, err := os.Open(src)
+		if err != nil {
+			return types.Atom{}, err
+		}
+		defer f.Close()
+
+		return db.ImportAtom(opts, f)
+	}
+
+	if err := db.checkQuota(); err != nil {
+		return types.Atom{}, err
+	}
+
+	// Hash the linked (or copied) file rather than src, so that what is
+	// stored is what was hashed even if src is replaced in the meantime.
+	w, tmp, err := local.Link(src)
+	if err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't link %s: %w", src, err)
+	}
+
+	f, err := os.Open(tmp)
+	if err != nil {
+		w.Abort()
+		return types.Atom{}, err
+	}
+
+	hash, err := opts.Algorithm.HashReader(f)
+	f.Close()
+	if err != nil {
+		w.Abort()
+		return types.Atom{}, err
+	}
+
+	if opts.Verify != nil {
+		if err := opts.Verify(types.Digest{Algorithm: opts.Algorithm, Hash: hash}); err != nil {
+			w.Abort()
+			return types.Atom{}, err
+		}
+	}
+
+	// Don't keep the link if we already have it.
+	atom, ok, err := db.GetAtomByHash(hash)
+	if err != nil || ok {
+		w.Abort()
+		if err != nil {
+			return types.Atom{}, err
+		}
+		return atom, db.touchAtom(atom.ID)
+	}
+
+	atom = types.Atom{
+		Name:        hash,
+		Hash:        hash,
+		Type:        opts.Type,
+		Algorithm:   opts.Algorithm,
+		Compression: types.NoCompression,
+		MediaType:   opts.MediaType,
+	}
+
+	atoms, err := db.CommitAtoms([]StagedAtom{{w, atom}})
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	return atoms[0], nil
+}
+
+// StagedAtom is an atom whose content has been written to the atom storage,
+// but that hasn't been committed or added to the db yet.
+type StagedAtom struct {
+	w    storage.Writer
+	atom types.Atom
+}
+
+// StageAtom writes content to the atom storage and hashes it, so that it can be
+// added to the store later with CommitAtoms. This is the slow part of an
+// import, and only reads the db, to check that the store isn't already full
+// before writing anything. That is checked again when the atom is committed,
+// in case other atoms were committed in the meantime.
+func (db *AtomfsDB) StageAtom(opts ImportOptions, content io.Reader) (StagedAtom, error) {
+	if err := db.checkQuota(); err != nil {
+		return StagedAtom{}, err
+	}
+
+	w, hash, err := db.writeTempAtom(opts.Algorithm, opts.Compression, content)
+	if err != nil {
+		return StagedAtom{}, err
+	}
+
+	if opts.Verify != nil {
+		if err := opts.Verify(types.Digest{Algorithm: opts.Algorithm, Hash: hash}); err != nil {
+			w.Abort()
+			return StagedAtom{}, err
+		}
+	}
+
+	atom := types.Atom{
+		Name:        hash,
+		Hash:        hash,
+		Type:        opts.Type,
+		Algorithm:   opts.Algorithm,
+		Compression: opts.Compression,
+		MediaType:   opts.MediaType,
+		KeyID:       db.keyID(),
+	}
+	return StagedAtom{w, atom}, nil
+}
+
+// CommitAtoms adds the staged atoms to the store in a single transaction,
+// returning them in the same order. Staged atoms that are already in the
+// store are discarded in favor of the existing ones. The staged atoms are
+// always consumed, even on failure; if the transaction fails, any atoms that
+// were already committed to the storage are left for GC to clean up.
+func (db *AtomfsDB) CommitAtoms(staged []StagedAtom) ([]types.Atom, error) {
+	atoms := []types.Atom{}
+	committed := 0
+
+	err := db.inTx(func(tx *AtomfsDB) error {
+		for _, s := range staged {
+			atom, err := tx.commitAtom(s)
+			committed++
+			if err != nil {
+				return err
+			}
+
+			atoms = append(atoms, atom)
+		}
+
+		return nil
+	})
+	if err != nil {
+		DiscardAtoms(staged[committed:])
+		return nil, err
+	}
+
+	return atoms, nil
+}
+
+func (db *AtomfsDB) commitAtom(s StagedAtom) (types.Atom, error) {
+	atom, ok, err := db.GetAtomByHash(s.atom.Hash)
+	if err != nil || ok {
+		s.w.Abort()
+		if err != nil {
+			return types.Atom{}, err
+		}
+		return atom, db.touchAtom(atom.ID)
+	}
+
+	if err := db.checkQuota(); err != nil {
+		s.w.Abort()
+		return types.Atom{}, err
+	}
+
+	if err := s.w.Commit(s.atom.FileName()); err != nil {
+		return types.Atom{}, fmt.Errorf("couldn't commit atom %s: %w", s.atom.Hash, err)
+	}
+
+	return db.insertAtom(s.atom)
+}
+
+// DiscardAtoms throws away staged atoms that won't be committed.
+func DiscardAtoms(staged []StagedAtom) {
+	for _, s := range staged {
+		s.w.Abort()
+	}
+}
+
+// GetAtomByHash looks up an atom by its hash; the bool return is false if
+// there is no such atom.
+func (db *AtomfsDB) GetAtomByHash(hash string) (types.Atom, bool, error) {
+	rows, err := db.q.Query("SELECT "+atomColumns+" FROM atoms WHERE hash = ?", hash)
+	if err != nil {
+		return types.Atom{}, false, err
+	}
+	defer rows.Close()
+
+	atoms, err := db.getAtoms(rows)
+	if err != nil {
+		return types.Atom{}, false, err
+	}
+
+	if len(atoms) == 0 {
+		return types.Atom{}, false, nil
+	}
+
+	return atoms[0], true, nil
+}
+
+// HasAtom reports whether an atom with the given hash exists.
+func (db *AtomfsDB) HasAtom(hash string) (bool, error) {
+	exists := false
+	err := db.q.QueryRow("SELECT EXISTS (SELECT 1 FROM atoms WHERE hash = ?)", hash).Scan(&exists)
+	return exists, err
+}
+
+// scanAtom reads an atom from the atomColumns of the current row.
+func scanAtom(rows *sql.Rows) (types.Atom, error) {
+	atom := types.Atom{}
+	size := sql.NullInt64{}
+	mediaType := sql.NullString{}
+	keyID := sql.NullString{}
+	err := rows.Scan(&atom.ID, &atom.Name, &atom.Hash, &atom.Type, &atom.Algorithm, &atom.Compression, &size, &atom.Chunked, &mediaType, &keyID, &atom.Pinned)
+	atom.Size = size.Int64
+	atom.SizeKnown = size.Valid
+	atom.MediaType = mediaType.String
+	atom.KeyID = keyID.String
+	return atom, err
 }
 
 func (db *AtomfsDB) getAtoms(rows *sql.Rows) ([]types.Atom, error) {
 	atoms := []types.Atom{}
 	for rows.Next() {
-		atom := types.Atom{}
-		err := rows.Scan(&atom.ID, &atom.Name, &atom.Hash, &atom.Type)
+		atom, err := scanAtom(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -87,7 +547,7 @@ func (db *AtomfsDB) getAtoms(rows *sql.Rows) ([]types.Atom, error) {
 }
 
 func (db *AtomfsDB) GetAtoms() ([]types.Atom, error) {
-	rows, err := db.DB.Query("SELECT id, name, hash, type FROM atoms")
+	rows, err := db.q.Query("SELECT " + atomColumns + " FROM atoms")
 	if err != nil {
 		return nil, err
 	}
@@ -96,81 +556,424 @@ func (db *AtomfsDB) GetAtoms() ([]types.Atom, error) {
 	return db.getAtoms(rows)
 }
 
-func (db *AtomfsDB) CreateMolecule(name string, atoms []types.Atom) (types.Molecule, error) {
-	stmt, err := db.DB.Prepare("INSERT INTO molecules (name) VALUES (?)")
+// GetAtomsPage returns up to limit atoms, ordered by id, skipping the first
+// offset of them.
+func (db *AtomfsDB) GetAtomsPage(offset int, limit int) ([]types.Atom, error) {
+	rows, err := db.q.Query("SELECT "+atomColumns+" FROM atoms ORDER BY atoms.id ASC LIMIT ? OFFSET ?", limit, offset)
 	if err != nil {
-		return types.Molecule{}, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	result, err := stmt.Exec(name)
-	stmt.Close()
+	return db.getAtoms(rows)
+}
+
+// ForEachAtom calls f with each atom in the db, streaming them from the db
+// rather than loading them all at once. If f returns an error, iteration
+// stops and the error is returned.
+func (db *AtomfsDB) ForEachAtom(f func(types.Atom) error) error {
+	rows, err := db.q.Query("SELECT " + atomColumns + " FROM atoms ORDER BY atoms.id ASC")
 	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		atom, err := scanAtom(rows)
+		if err != nil {
+			return err
+		}
+
+		if err := f(atom); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (db *AtomfsDB) CountAtoms() (int, error) {
+	count := 0
+	err := db.q.QueryRow("SELECT COUNT(*) FROM atoms").Scan(&count)
+	return count, err
+}
+
+// AtomUsage returns how many atoms there are, and the total of their recorded
+// sizes. Chunked atoms count as their whole size, even though they may share
+// chunks with other atoms.
+func (db *AtomfsDB) AtomUsage() (int, int64, error) {
+	count := 0
+	size := int64(0)
+	err := db.q.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM atoms").Scan(&count, &size)
+	return count, size, err
+}
+
+// checkQuota fails with an error wrapping types.ErrStoreFull if the config's
+// MaxAtoms or MaxBytes leave no room for another atom.
+func (db *AtomfsDB) checkQuota() error {
+	if db.config.MaxAtoms == 0 && db.config.MaxBytes == 0 {
+		return nil
+	}
+
+	count, size, err := db.AtomUsage()
+	if err != nil {
+		return err
+	}
+
+	if db.config.MaxAtoms > 0 && count >= db.config.MaxAtoms {
+		return fmt.Errorf("%w: it has %d atoms, and the limit is %d", types.ErrStoreFull, count, db.config.MaxAtoms)
+	}
+
+	if db.config.MaxBytes > 0 && size >= db.config.MaxBytes {
+		return fmt.Errorf("%w: its atoms are %d bytes, and the limit is %d", types.ErrStoreFull, size, db.config.MaxBytes)
+	}
+
+	return nil
+}
+
+func (db *AtomfsDB) CreateMolecule(name string, atoms []types.Atom) (types.Molecule, error) {
+	mol := types.Molecule{}
+	err := db.inTx(func(tx *AtomfsDB) error {
+		var err error
+		mol, err = tx.createMolecule(name, atoms)
+		return err
+	})
+	return mol, err
+}
+
+func (db *AtomfsDB) createMolecule(name string, atoms []types.Atom) (types.Molecule, error) {
+	if err := db.checkNoMolecule(name); err != nil {
 		return types.Molecule{}, err
 	}
 
-	stmt, err = db.DB.Prepare("INSERT INTO molecule_atoms (molecule_id, atom_id) VALUES (?, ?)")
+	stmt, err := db.q.Prepare("INSERT INTO molecules (name, created) VALUES (?, ?)")
 	if err != nil {
 		return types.Molecule{}, err
 	}
-	defer stmt.Close()
+
+	result, err := stmt.Exec(name, time.Now().UTC())
+	stmt.Close()
+	if err != nil {
+		return types.Molecule{}, wrapDBError(err)
+	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
 		return types.Molecule{}, err
 	}
 
+	if err := db.insertMoleculeAtoms(id, atoms); err != nil {
+		return types.Molecule{}, err
+	}
+
+	return types.Molecule{id, name, atoms}, nil
+}
+
+func (db *AtomfsDB) insertMoleculeAtoms(id int64, atoms []types.Atom) error {
+	stmt, err := db.q.Prepare("INSERT INTO molecule_atoms (molecule_id, atom_id) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
 	for _, a := range atoms {
 		_, err = stmt.Exec(id, a.ID)
 		if err != nil {
-			// TODO: cleanup?
-			return types.Molecule{}, err
+			return wrapDBError(err)
 		}
 	}
 
-	return types.Molecule{id, name, atoms}, nil
+	return nil
+}
+
+// ReplaceAtom makes every molecule that references the atom with id old
+// reference the atom with id new instead, and then deletes the old atom from
+// the db. Molecules that referenced both atoms keep only the first of them,
+// so they don't end up with the same atom twice.
+func (db *AtomfsDB) ReplaceAtom(old int64, new int64) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		_, err := tx.q.Exec("UPDATE molecule_atoms SET atom_id = ? WHERE atom_id = ?", new, old)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.q.Exec(`
+			DELETE FROM molecule_atoms
+			WHERE atom_id = ? AND id NOT IN (
+				SELECT MIN(id) FROM molecule_atoms WHERE atom_id = ? GROUP BY molecule_id
+			)`, new, new)
+		if err != nil {
+			return err
+		}
+
+		return tx.DeleteThing(old, "atom")
+	})
+}
+
+// SetAtomHash changes the hash and name of the atom with the given id.
+// Molecules reference atoms by id, so they don't need to change.
+func (db *AtomfsDB) SetAtomHash(id int64, hash string, name string) error {
+	_, err := db.q.Exec("UPDATE atoms SET hash = ?, name = ? WHERE id = ?", hash, name, id)
+	return err
 }
 
+// SetMoleculeAtoms replaces the atoms of the molecule with the given id, in a
+// single transaction.
+func (db *AtomfsDB) SetMoleculeAtoms(id int64, atoms []types.Atom) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		_, err := tx.q.Exec("DELETE FROM molecule_atoms WHERE molecule_id = ?", id)
+		if err != nil {
+			return err
+		}
+
+		return tx.insertMoleculeAtoms(id, atoms)
+	})
+}
+
+// CopyMolecule creates a molecule named dest with the same atoms as src, in a
+// single transaction so that src can't change out from under the copy.
+func (db *AtomfsDB) CopyMolecule(dest string, src string) (types.Molecule, error) {
+	mol := types.Molecule{}
+	err := db.inTx(func(tx *AtomfsDB) error {
+		source, err := tx.GetMolecule(src)
+		if err != nil {
+			return err
+		}
+
+		mol, err = tx.createMolecule(dest, source.Atoms)
+		return err
+	})
+	return mol, err
+}
+
+// GetMolecule looks up a molecule and its atoms by name, returning an error
+// wrapping types.ErrMoleculeNotFound if it doesn't exist.
 func (db *AtomfsDB) GetMolecule(name string) (types.Molecule, error) {
-	rows, err := db.DB.Query("SELECT id, name FROM molecules WHERE name=?", name)
+	mol := types.Molecule{}
+	err := db.q.QueryRow("SELECT id, name FROM molecules WHERE name = ? AND deleted_at IS NULL", name).Scan(&mol.ID, &mol.Name)
+	if err == sql.ErrNoRows {
+		return types.Molecule{}, fmt.Errorf("%w: %s", types.ErrMoleculeNotFound, name)
+	} else if err != nil {
+		return types.Molecule{}, err
+	}
+
+	mol.Atoms, err = db.getMoleculeAtoms(mol.ID)
 	if err != nil {
 		return types.Molecule{}, err
 	}
+
+	return mol, nil
+}
+
+func (db *AtomfsDB) getMoleculeAtoms(id int64) ([]types.Atom, error) {
+	rows, err := db.q.Query(`
+		SELECT `+atomColumns+`
+		FROM atoms JOIN molecule_atoms ON atoms.id = molecule_atoms.atom_id
+		WHERE molecule_atoms.molecule_id = ?
+		ORDER BY molecule_atoms.id ASC`, id)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	mol := types.Molecule{}
+	return db.getAtoms(rows)
+}
+
+// GetMoleculesUsingAtom returns all of the molecules that reference the atom
+// with the given id.
+func (db *AtomfsDB) GetMoleculesUsingAtom(id int64) ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT DISTINCT molecules.id, molecules.name
+		FROM molecules JOIN molecule_atoms ON molecules.id = molecule_atoms.molecule_id
+		WHERE molecule_atoms.atom_id = ? AND molecules.deleted_at IS NULL
+		ORDER BY molecules.id ASC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
+
+// GetDeletedMoleculesUsingAtom is like GetMoleculesUsingAtom, but returns the
+// soft deleted molecules that still reference the atom instead.
+func (db *AtomfsDB) GetDeletedMoleculesUsingAtom(id int64) ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT DISTINCT molecules.id, molecules.name
+		FROM molecules JOIN molecule_atoms ON molecules.id = molecule_atoms.molecule_id
+		WHERE molecule_atoms.atom_id = ? AND molecules.deleted_at IS NOT NULL
+		ORDER BY molecules.id ASC`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
+
+// GetMoleculesUsingAtomHash returns all of the molecules that reference the
+// atom with the given hash.
+func (db *AtomfsDB) GetMoleculesUsingAtomHash(hash string) ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT DISTINCT molecules.id, molecules.name
+		FROM molecules
+			JOIN molecule_atoms ON molecules.id = molecule_atoms.molecule_id
+			JOIN atoms ON atoms.id = molecule_atoms.atom_id
+		WHERE atoms.hash = ? AND molecules.deleted_at IS NULL
+		ORDER BY molecules.id ASC`, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
+
+// DanglingReference is a molecule_atoms row that refers to an atom or molecule
+// that doesn't exist.
+type DanglingReference struct {
+	MoleculeID int64
+	// Molecule is the name of the molecule, or empty if the molecule
+	// doesn't exist either.
+	Molecule string
+	AtomID   int64
+}
+
+// GetDanglingReferences finds the references from molecules to atoms where
+// either end is missing. Foreign keys should prevent these, but they can't
+// protect against the db being edited without them enabled.
+func (db *AtomfsDB) GetDanglingReferences() ([]DanglingReference, error) {
+	rows, err := db.q.Query(`
+		SELECT molecule_atoms.molecule_id, COALESCE(molecules.name, ''), molecule_atoms.atom_id
+		FROM molecule_atoms
+			LEFT JOIN molecules ON molecules.id = molecule_atoms.molecule_id
+			LEFT JOIN atoms ON atoms.id = molecule_atoms.atom_id
+		WHERE molecules.id IS NULL OR atoms.id IS NULL
+		ORDER BY molecule_atoms.id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := []DanglingReference{}
 	for rows.Next() {
-		err = rows.Scan(&mol.ID, &mol.Name)
+		ref := DanglingReference{}
+		if err := rows.Scan(&ref.MoleculeID, &ref.Molecule, &ref.AtomID); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+
+	return refs, rows.Err()
+}
+
+// getMolecules reads molecule (id, name) pairs from rows, and then fills in
+// their atoms. rows is closed before the atoms are queried.
+func (db *AtomfsDB) getMolecules(rows *sql.Rows) ([]types.Molecule, error) {
+	mols := []types.Molecule{}
+	for rows.Next() {
+		mol := types.Molecule{}
+		if err := rows.Scan(&mol.ID, &mol.Name); err != nil {
+			return nil, err
+		}
+		mols = append(mols, mol)
+	}
+	rows.Close()
+
+	for i := range mols {
+		atoms, err := db.getMoleculeAtoms(mols[i].ID)
 		if err != nil {
-			return types.Molecule{}, err
+			return nil, err
 		}
+		mols[i].Atoms = atoms
 	}
 
-	rows, err = db.DB.Query(`
-		SELECT atoms.id, atoms.name, atoms.hash, atoms.type
-		FROM atoms JOIN molecule_atoms ON atoms.id = molecule_atoms.atom_id
-		WHERE molecule_atoms.molecule_id = ?
-		ORDER BY molecule_atoms.id ASC`, mol.ID)
+	return mols, nil
+}
+
+// GetMoleculesCreatedBefore returns the molecules that were created before
+// cutoff, other than any that are mounted or pinned. Molecules created before
+// creation times were recorded are never returned.
+func (db *AtomfsDB) GetMoleculesCreatedBefore(cutoff time.Time) ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT molecules.id, molecules.name FROM molecules
+		WHERE molecules.created IS NOT NULL AND molecules.created < ?
+			AND molecules.deleted_at IS NULL AND NOT molecules.pinned
+			AND NOT EXISTS (SELECT 1 FROM mounts WHERE mounts.molecule_id = molecules.id)
+		ORDER BY molecules.id ASC`, cutoff.UTC())
 	if err != nil {
-		return types.Molecule{}, err
+		return nil, err
 	}
 	defer rows.Close()
 
-	mol.Atoms, err = db.getAtoms(rows)
+	return db.getMolecules(rows)
+}
+
+// GetEmptyMolecules returns the molecules that have no atoms, other than any
+// that are mounted or pinned.
+func (db *AtomfsDB) GetEmptyMolecules() ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT molecules.id, molecules.name FROM molecules
+		WHERE molecules.deleted_at IS NULL AND NOT molecules.pinned
+			AND NOT EXISTS (SELECT 1 FROM molecule_atoms WHERE molecule_atoms.molecule_id = molecules.id)
+			AND NOT EXISTS (SELECT 1 FROM mounts WHERE mounts.molecule_id = molecules.id)
+		ORDER BY molecules.id ASC`)
 	if err != nil {
-		return types.Molecule{}, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return mol, nil
+	return db.getMolecules(rows)
+}
+
+// GetMolecules returns all of the molecules in the db, with their atoms.
+func (db *AtomfsDB) GetMolecules() ([]types.Molecule, error) {
+	rows, err := db.q.Query("SELECT id, name FROM molecules WHERE deleted_at IS NULL ORDER BY id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
+
+// GetMoleculesPage returns up to limit molecules with their atoms, ordered by
+// id, skipping the first offset of them.
+func (db *AtomfsDB) GetMoleculesPage(offset int, limit int) ([]types.Molecule, error) {
+	rows, err := db.q.Query("SELECT id, name FROM molecules WHERE deleted_at IS NULL ORDER BY id ASC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
+
+func (db *AtomfsDB) CountMolecules() (int, error) {
+	count := 0
+	err := db.q.QueryRow("SELECT COUNT(*) FROM molecules WHERE deleted_at IS NULL").Scan(&count)
+	return count, err
+}
+
+// CountAtomReferences returns the number of molecules that reference the atom
+// with the given id.
+func (db *AtomfsDB) CountAtomReferences(id int64) (int, error) {
+	count := 0
+	err := db.q.QueryRow("SELECT COUNT(*) FROM molecule_atoms WHERE atom_id = ?", id).Scan(&count)
+	return count, err
 }
 
+// unusedAtomsQuery selects the atoms that aren't referenced by any molecule.
+const unusedAtomsQuery = `
+	SELECT ` + atomColumns + `
+	FROM atoms
+	WHERE atoms.id not in (
+		SELECT atoms.id
+		FROM atoms JOIN molecule_atoms ON atoms.id = molecule_atoms.atom_id
+	)`
+
 func (db *AtomfsDB) GetUnusedAtoms() ([]types.Atom, error) {
-	rows, err := db.DB.Query(`
-		SELECT atoms.id, atoms.name, atoms.hash, atoms.type
-		FROM atoms
-		WHERE atoms.id not in (
-			SELECT atoms.id
-			FROM atoms JOIN molecule_atoms ON atoms.id = molecule_atoms.atom_id
-		)`)
+	rows, err := db.q.Query(unusedAtomsQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -179,12 +982,154 @@ func (db *AtomfsDB) GetUnusedAtoms() ([]types.Atom, error) {
 	return db.getAtoms(rows)
 }
 
-func (db *AtomfsDB) DeleteThing(id int64, table string) error {
-	_, err := db.DB.Exec(fmt.Sprintf("DELETE FROM %ss WHERE id = ?", table), id)
+// GetUnusedAtomsLRU is like GetUnusedAtoms, but returns the atoms least
+// recently used first.
+func (db *AtomfsDB) GetUnusedAtomsLRU() ([]types.Atom, error) {
+	rows, err := db.q.Query(unusedAtomsQuery + " ORDER BY atoms.last_used ASC, atoms.id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getAtoms(rows)
+}
+
+// TouchAtoms marks the atoms as having just been used.
+func (db *AtomfsDB) TouchAtoms(atoms []types.Atom) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		stmt, err := tx.q.Prepare("UPDATE atoms SET last_used = ? WHERE id = ?")
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		now := time.Now().UTC()
+		for _, atom := range atoms {
+			if _, err := stmt.Exec(now, atom.ID); err != nil {
+				return wrapDBError(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// touchAtom marks the atom with the given id as just used, e.g. because it was
+// imported again.
+func (db *AtomfsDB) touchAtom(id int64) error {
+	_, err := db.q.Exec("UPDATE atoms SET last_used = ? WHERE id = ?", time.Now().UTC(), id)
 	return err
 }
 
+func (db *AtomfsDB) DeleteThing(id int64, table string) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		_, err := tx.q.Exec(fmt.Sprintf("DELETE FROM %ss WHERE id = ?", table), id)
+		return err
+	})
+}
+
 func (db *AtomfsDB) RenameThing(id int64, table string, newName string) error {
-	_, err := db.DB.Exec(fmt.Sprintf("UPDATE %ss SET name = ? WHERE id = ?", table), newName, id)
+	_, err := db.q.Exec(fmt.Sprintf("UPDATE %ss SET name = ? WHERE id = ?", table), newName, id)
+	return err
+}
+
+// checkNoMolecule fails with an error wrapping types.ErrMoleculeExists if a
+// molecule called name exists.
+func (db *AtomfsDB) checkNoMolecule(name string) error {
+	count := 0
+	err := db.q.QueryRow("SELECT COUNT(*) FROM molecules WHERE name = ? AND deleted_at IS NULL", name).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("%w: %s", types.ErrMoleculeExists, name)
+	}
+
+	return nil
+}
+
+// RenameMolecule renames a molecule in a single transaction, failing with an
+// error wrapping types.ErrMoleculeExists if a molecule named newName already
+// exists.
+func (db *AtomfsDB) RenameMolecule(oldName string, newName string) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		if err := tx.checkNoMolecule(newName); err != nil {
+			return err
+		}
+
+		result, err := tx.q.Exec("UPDATE molecules SET name = ? WHERE name = ? AND deleted_at IS NULL", newName, oldName)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return fmt.Errorf("%w: %s", types.ErrMoleculeNotFound, oldName)
+		}
+
+		return nil
+	})
+}
+
+// Ping checks that the db is responsive by running a trivial query.
+func (db *AtomfsDB) Ping(ctx context.Context) error {
+	version := 0
+	return db.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema").Scan(&version)
+}
+
+// SoftDeleteMolecule marks the molecule with the given id as deleted, which
+// hides it from everything but RestoreMolecule and GetMoleculesDeletedBefore.
+// Its atoms are still referenced, so GC leaves them alone.
+func (db *AtomfsDB) SoftDeleteMolecule(id int64) error {
+	_, err := db.q.Exec("UPDATE molecules SET deleted_at = ? WHERE id = ?", time.Now().UTC(), id)
 	return err
 }
+
+// RestoreMolecule undoes the most recent SoftDeleteMolecule of a molecule
+// called name, as long as it was deleted after cutoff. It fails with an error
+// wrapping types.ErrMoleculeNotFound if there is no such molecule, and with
+// one wrapping types.ErrMoleculeExists if another molecule called name has
+// been created since.
+func (db *AtomfsDB) RestoreMolecule(name string, cutoff time.Time) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		if err := tx.checkNoMolecule(name); err != nil {
+			return err
+		}
+
+		id := int64(0)
+		err := tx.q.QueryRow(`
+			SELECT id FROM molecules
+			WHERE name = ? AND deleted_at IS NOT NULL AND deleted_at >= ?
+			ORDER BY deleted_at DESC LIMIT 1`, name, cutoff.UTC()).Scan(&id)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: no deleted molecule %s to restore", types.ErrMoleculeNotFound, name)
+		} else if err != nil {
+			return err
+		}
+
+		_, err = tx.q.Exec("UPDATE molecules SET deleted_at = NULL WHERE id = ?", id)
+		return err
+	})
+}
+
+// GetMoleculesDeletedBefore returns the soft deleted molecules that were
+// deleted before cutoff, with their atoms, other than any that are still
+// mounted: those can't be purged until they're unmounted.
+func (db *AtomfsDB) GetMoleculesDeletedBefore(cutoff time.Time) ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT molecules.id, molecules.name FROM molecules
+		WHERE molecules.deleted_at IS NOT NULL AND molecules.deleted_at < ?
+			AND NOT EXISTS (SELECT 1 FROM mounts WHERE mounts.molecule_id = molecules.id)
+		ORDER BY molecules.id ASC`, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
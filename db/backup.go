@@ -0,0 +1,139 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// backupPagesPerStep is how many pages are copied at a time during a backup.
+// sqlite only holds a read lock on the source db during each step, so
+// writers can make progress in between.
+const backupPagesPerStep = 100
+
+// Backup writes a consistent copy of the db to w, using sqlite's online backup
+// API. It is safe to call while the db is in use.
+func (db *AtomfsDB) Backup(w io.Writer) error {
+	dir, err := ioutil.TempDir("", "atomfs-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	backupPath := path.Join(dir, "atomfs.db")
+	if err := db.backupTo(backupPath); err != nil {
+		return err
+	}
+
+	f, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// CloneTo writes a consistent copy of the db to a new db at dest, which must
+// not already exist. Mount records are dropped from the copy, since nothing is
+// mounted from it.
+func (db *AtomfsDB) CloneTo(dest string) error {
+	if _, err := os.Stat(dest); err == nil {
+		return errors.Errorf("%s already exists", dest)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := db.backupTo(dest); err != nil {
+		os.Remove(dest)
+		return err
+	}
+
+	clone, err := sql.Open("sqlite3_with_fk", dest)
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	defer clone.Close()
+
+	if _, err := clone.Exec("DELETE FROM mounts"); err != nil {
+		os.Remove(dest)
+		return err
+	}
+
+	return nil
+}
+
+// Vacuum rebuilds the db to reclaim the space left behind by deleted rows.
+func (db *AtomfsDB) Vacuum() error {
+	if db.tx != nil {
+		return errors.Errorf("can't vacuum in a transaction")
+	}
+
+	return db.retry(func() error {
+		_, err := db.DB.Exec("VACUUM")
+		return err
+	})
+}
+
+// backupTo copies the db to a new sqlite db at dest.
+func (db *AtomfsDB) backupTo(dest string) error {
+	destDB, err := sql.Open("sqlite3_with_fk", dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+
+	ctx := context.Background()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSqlite, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.Errorf("unexpected sqlite connection type %T", destDriverConn)
+			}
+
+			srcSqlite, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.Errorf("unexpected sqlite connection type %T", srcDriverConn)
+			}
+
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return errors.Wrapf(err, "couldn't start backup")
+			}
+
+			for {
+				done, err := backup.Step(backupPagesPerStep)
+				if err != nil {
+					backup.Finish()
+					return errors.Wrapf(err, "backup failed")
+				}
+
+				if done {
+					break
+				}
+			}
+
+			return backup.Finish()
+		})
+	})
+}
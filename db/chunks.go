@@ -0,0 +1,282 @@
+package db
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// Chunk sizes. Layers are usually big, so chunks are too; much smaller and
+// the db would be mostly chunk rows.
+const (
+	chunkMin = 256 * 1024
+	chunkAvg = 1024 * 1024
+	chunkMax = 4 * 1024 * 1024
+)
+
+// FastCDC's normalized chunking uses a harder to hit mask before the average
+// chunk size and an easier one after it, which keeps chunk sizes close to the
+// average. Using the high bits means each cut point depends on the last 64
+// bytes.
+const (
+	chunkMaskSmall = uint64(1<<22-1) << (64 - 22)
+	chunkMaskLarge = uint64(1<<18-1) << (64 - 18)
+)
+
+// gear is FastCDC's table of random values for each byte. It must never
+// change, or the same content would be chunked differently than before.
+var gear [256]uint64
+
+func init() {
+	// splitmix64, from a fixed seed.
+	x := uint64(0x61746f6d6673)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunkCut returns the length of the first chunk of data, which is at most
+// chunkMax bytes long.
+func chunkCut(data []byte) int {
+	n := len(data)
+	if n > chunkMax {
+		n = chunkMax
+	}
+
+	if n <= chunkMin {
+		return n
+	}
+
+	normal := chunkAvg
+	if n < normal {
+		normal = n
+	}
+
+	fp := uint64(0)
+	i := chunkMin
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskSmall == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&chunkMaskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
+
+// chunker splits a stream into content defined chunks.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, chunkMax)}
+}
+
+// next returns the next chunk, or io.EOF once there are no more.
+func (c *chunker) next() ([]byte, error) {
+	if !c.eof && c.n < len(c.buf) {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := chunkCut(c.buf[:c.n])
+	chunk := make([]byte, cut)
+	copy(chunk, c.buf)
+	c.n = copy(c.buf, c.buf[cut:c.n])
+	return chunk, nil
+}
+
+// ImportChunkedAtom is like ImportAtom, but splits content into content
+// defined chunks, which are stored (if they aren't already) instead of a file
+// for the whole atom. Chunks are never compressed, so opts.Compression is
+// ignored. Chunks that are written for an atom that turns out to exist
+// already are left for GC to clean up.
+//
+// Chunks are shared between atoms by their hash, so they can't be encrypted;
+// this fails if the config has an Encrypter rather than store the atom in the
+// clear.
+func (db *AtomfsDB) ImportChunkedAtom(opts ImportOptions, content io.Reader) (types.Atom, error) {
+	if db.config.Encrypter != nil {
+		return types.Atom{}, fmt.Errorf("chunked atoms can't be encrypted")
+	}
+
+	if err := db.checkQuota(); err != nil {
+		return types.Atom{}, err
+	}
+
+	h, err := opts.Algorithm.New()
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	chunks := []types.Chunk{}
+	size := int64(0)
+	c := newChunker(io.TeeReader(content, h))
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return types.Atom{}, err
+		}
+
+		chunk, err := db.writeChunk(data)
+		if err != nil {
+			return types.Atom{}, err
+		}
+
+		chunks = append(chunks, chunk)
+		size += chunk.Size
+	}
+
+	hash := fmt.Sprintf("%x", h.Sum(nil))
+	if opts.Verify != nil {
+		if err := opts.Verify(types.Digest{Algorithm: opts.Algorithm, Hash: hash}); err != nil {
+			return types.Atom{}, err
+		}
+	}
+
+	atom := types.Atom{
+		Name:        hash,
+		Hash:        hash,
+		Type:        opts.Type,
+		Algorithm:   opts.Algorithm,
+		Compression: types.NoCompression,
+		MediaType:   opts.MediaType,
+		Size:        size,
+		SizeKnown:   true,
+		Chunked:     true,
+	}
+
+	return db.AddAtomRecord(atom, chunks)
+}
+
+// AddAtomRecord adds atom, and its chunks if it is chunked, to the db as they
+// are, without looking at the storage. If an atom with the same hash already
+// exists, it is returned instead.
+func (db *AtomfsDB) AddAtomRecord(atom types.Atom, chunks []types.Chunk) (types.Atom, error) {
+	err := db.inTx(func(tx *AtomfsDB) error {
+		existing, ok, err := tx.GetAtomByHash(atom.Hash)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			atom = existing
+			return tx.touchAtom(atom.ID)
+		}
+
+		atom, err = tx.insertAtomRow(atom)
+		if err != nil {
+			return err
+		}
+
+		for i, chunk := range chunks {
+			_, err := tx.q.Exec("INSERT INTO atom_chunks (atom_id, seq, hash, size) VALUES (?, ?, ?, ?)", atom.ID, i, chunk.Hash, chunk.Size)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return types.Atom{}, err
+	}
+
+	return atom, nil
+}
+
+// writeChunk stores data as a chunk, unless a chunk with the same content is
+// already stored.
+func (db *AtomfsDB) writeChunk(data []byte) (types.Chunk, error) {
+	chunk := types.Chunk{Hash: fmt.Sprintf("%x", sha256.Sum256(data)), Size: int64(len(data))}
+	if _, err := db.storage.Stat(chunk.FileName()); err == nil {
+		return chunk, nil
+	}
+
+	w, err := db.storage.Create()
+	if err != nil {
+		return types.Chunk{}, fmt.Errorf("couldn't create chunk file: %w", err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return types.Chunk{}, fmt.Errorf("couldn't write chunk %s: %w", chunk.Hash, err)
+	}
+
+	if err := w.Commit(chunk.FileName()); err != nil {
+		return types.Chunk{}, fmt.Errorf("couldn't commit chunk %s: %w", chunk.Hash, err)
+	}
+
+	return chunk, nil
+}
+
+// GetAtomChunks returns the chunks of the atom with the given id, in order.
+// Atoms that aren't chunked have none.
+func (db *AtomfsDB) GetAtomChunks(atomID int64) ([]types.Chunk, error) {
+	rows, err := db.q.Query("SELECT hash, size FROM atom_chunks WHERE atom_id = ? ORDER BY seq ASC", atomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := []types.Chunk{}
+	for rows.Next() {
+		chunk := types.Chunk{}
+		if err := rows.Scan(&chunk.Hash, &chunk.Size); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// GetChunkUsers returns the ids of the atoms that use each chunk, by the
+// chunk's hash.
+func (db *AtomfsDB) GetChunkUsers() (map[string][]int64, error) {
+	rows, err := db.q.Query("SELECT DISTINCT hash, atom_id FROM atom_chunks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string][]int64{}
+	for rows.Next() {
+		hash := ""
+		id := int64(0)
+		if err := rows.Scan(&hash, &id); err != nil {
+			return nil, err
+		}
+		users[hash] = append(users[hash], id)
+	}
+
+	return users, rows.Err()
+}
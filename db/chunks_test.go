@@ -0,0 +1,81 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkHashes(t *testing.T, data []byte) [][sha256.Size]byte {
+	hashes := [][sha256.Size]byte{}
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return hashes
+		} else if err != nil {
+			t.Fatalf("couldn't chunk %s", err)
+		}
+
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+}
+
+func TestChunkBoundariesStable(t *testing.T) {
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	before := chunkHashes(t, data)
+	if len(before) < 4 {
+		t.Fatalf("expected several chunks, got %d", len(before))
+	}
+
+	// Insert a few bytes near the start; only the chunks around them
+	// should change.
+	inserted := append(append(append([]byte{}, data[:1000]...), []byte("hello")...), data[1000:]...)
+	after := chunkHashes(t, inserted)
+
+	seen := map[[sha256.Size]byte]bool{}
+	for _, h := range before {
+		seen[h] = true
+	}
+
+	shared := 0
+	for _, h := range after {
+		if seen[h] {
+			shared++
+		}
+	}
+
+	if shared < len(before)-2 {
+		t.Fatalf("only %d of %d chunks survived an insert", shared, len(before))
+	}
+}
+
+func TestChunksReassemble(t *testing.T) {
+	data := make([]byte, 9*1024*1024+17)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	reassembled := []byte{}
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("couldn't chunk %s", err)
+		}
+
+		if len(chunk) > chunkMax {
+			t.Fatalf("chunk of %d bytes is bigger than the max", len(chunk))
+		}
+
+		reassembled = append(reassembled, chunk...)
+	}
+
+	if !bytes.Equal(data, reassembled) {
+		t.Fatalf("chunks don't reassemble to the original content")
+	}
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// wrapDBError wraps an error from sqlite in a types.Error of kind types.ErrDB,
+// so that callers can recognize it without depending on the driver's error
+// text. Errors that already have a kind, and sql.ErrNoRows (which the db
+// package checks for itself), are returned as they are.
+func wrapDBError(err error) error {
+	if err == nil || err == sql.ErrNoRows {
+		return err
+	}
+
+	var kinded *types.Error
+	if errors.As(err, &kinded) {
+		return err
+	}
+
+	return types.WrapError(types.ErrDB, "", err)
+}
+
+// errQuerier is a querier whose Exec, Query and Prepare wrap their errors
+// with wrapDBError. Errors from QueryRow only show up when its result is
+// scanned, so those are left to the caller.
+type errQuerier struct {
+	q querier
+}
+
+func (q errQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	result, err := q.q.Exec(query, args...)
+	return result, wrapDBError(err)
+}
+
+func (q errQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := q.q.Query(query, args...)
+	return rows, wrapDBError(err)
+}
+
+func (q errQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return q.q.QueryRow(query, args...)
+}
+
+func (q errQuerier) Prepare(query string) (*sql.Stmt, error) {
+	stmt, err := q.q.Prepare(query)
+	return stmt, wrapDBError(err)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/anuvu/atomfs/types"
+	"github.com/pkg/errors"
+)
+
+func externalSchemaVersion(q querier, name string) (int, error) {
+	version := 0
+	err := q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM external_schema WHERE name = ?", name).Scan(&version)
+	return version, err
+}
+
+// migrateExternal brings each of schemas up to its latest version in a single
+// transaction, like migrate does for atomfs' own schema.
+func migrateExternal(db *sql.DB, schemas []types.ExternalSchema) error {
+	if len(schemas) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, schema := range schemas {
+		version, err := externalSchemaVersion(tx, schema.Name)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get %s schema version", schema.Name)
+		}
+
+		if version > len(schema.Migrations) {
+			return errors.Errorf("%s schema version %d is newer than the registered one (%d)", schema.Name, version, len(schema.Migrations))
+		}
+
+		for ; version < len(schema.Migrations); version++ {
+			_, err = tx.Exec(schema.Migrations[version])
+			if err != nil {
+				return errors.Wrapf(err, "couldn't migrate %s schema to version %d", schema.Name, version+1)
+			}
+
+			_, err = tx.Exec("INSERT INTO external_schema (name, version, updated) VALUES (?, ?, datetime('now'))", schema.Name, version+1)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't record %s schema version %d", schema.Name, version+1)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// checkExternal checks that a db that can't be migrated already has each of
+// schemas at its latest version.
+func checkExternal(db *sql.DB, schemas []types.ExternalSchema) error {
+	for _, schema := range schemas {
+		version, err := externalSchemaVersion(db, schema.Name)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't get %s schema version", schema.Name)
+		}
+
+		if version != len(schema.Migrations) {
+			return errors.Errorf("%s schema version %d doesn't match the registered one (%d); open it read-write to migrate it", schema.Name, version, len(schema.Migrations))
+		}
+	}
+
+	return nil
+}
+
+// Exec runs a statement against the db, inside the transaction if db is one.
+// It is meant for tables registered with types.ExternalSchema; atomfs' own
+// tables should only be changed through the other methods.
+func (db *AtomfsDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.q.Exec(query, args...)
+}
+
+// Query is like Exec, for queries that return rows.
+func (db *AtomfsDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.q.Query(query, args...)
+}
+
+// QueryRow is like Exec, for queries that return at most one row.
+func (db *AtomfsDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.q.QueryRow(query, args...)
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// FSCKCheckpoint is the result of checking an atom, along with enough about
+// its file to tell whether it has changed since.
+type FSCKCheckpoint struct {
+	AtomID  int64
+	Size    int64
+	ModTime time.Time
+	OK      bool
+	// Kind and Err describe the problem with the atom, if it's not OK.
+	Kind int
+	Err  string
+}
+
+// GetFSCKCheckpoint looks up the last recorded FSCK result for an atom; the
+// bool return is false if there isn't one.
+func (db *AtomfsDB) GetFSCKCheckpoint(atomID int64) (FSCKCheckpoint, bool, error) {
+	c := FSCKCheckpoint{AtomID: atomID}
+	mtime := int64(0)
+
+	err := db.q.QueryRow("SELECT size, mtime, ok, kind, error FROM fsck_checkpoints WHERE atom_id = ?", atomID).
+		Scan(&c.Size, &mtime, &c.OK, &c.Kind, &c.Err)
+	if err == sql.ErrNoRows {
+		return FSCKCheckpoint{}, false, nil
+	} else if err != nil {
+		return FSCKCheckpoint{}, false, err
+	}
+
+	c.ModTime = time.Unix(0, mtime)
+	return c, true, nil
+}
+
+// SetFSCKCheckpoint records the result of checking an atom, replacing any
+// earlier one.
+func (db *AtomfsDB) SetFSCKCheckpoint(c FSCKCheckpoint) error {
+	_, err := db.q.Exec(
+		"INSERT OR REPLACE INTO fsck_checkpoints (atom_id, size, mtime, ok, kind, error, checked) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		c.AtomID, c.Size, c.ModTime.UnixNano(), c.OK, c.Kind, c.Err, time.Now().UTC())
+	return err
+}
+
+// ClearFSCKCheckpoints forgets all recorded FSCK results.
+func (db *AtomfsDB) ClearFSCKCheckpoints() error {
+	_, err := db.q.Exec("DELETE FROM fsck_checkpoints")
+	return err
+}
+
+// fsckRunHistory is how many FSCK runs are remembered. The last clean run is
+// always kept, however long ago it was.
+const fsckRunHistory = 100
+
+// AddFSCKRun records a completed FSCK, forgetting the oldest runs beyond
+// fsckRunHistory.
+func (db *AtomfsDB) AddFSCKRun(run types.FSCKRun) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		_, err := tx.q.Exec(
+			"INSERT INTO fsck_runs (started, finished, atoms, errors) VALUES (?, ?, ?, ?)",
+			run.Started.UnixNano(), run.Finished.UnixNano(), run.Atoms, run.Errors)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.q.Exec(`
+			DELETE FROM fsck_runs
+			WHERE id NOT IN (SELECT id FROM fsck_runs ORDER BY id DESC LIMIT ?)
+				AND id != (SELECT COALESCE(MAX(id), 0) FROM fsck_runs WHERE errors = 0)`,
+			fsckRunHistory)
+		return err
+	})
+}
+
+// GetLastFSCKRun returns the most recent FSCK run, or if clean is true, the
+// most recent one that found no problems; the bool return is false if there
+// isn't one.
+func (db *AtomfsDB) GetLastFSCKRun(clean bool) (types.FSCKRun, bool, error) {
+	query := "SELECT started, finished, atoms, errors FROM fsck_runs ORDER BY id DESC LIMIT 1"
+	if clean {
+		query = "SELECT started, finished, atoms, errors FROM fsck_runs WHERE errors = 0 ORDER BY id DESC LIMIT 1"
+	}
+
+	run := types.FSCKRun{}
+	started := int64(0)
+	finished := int64(0)
+	err := db.q.QueryRow(query).Scan(&started, &finished, &run.Atoms, &run.Errors)
+	if err == sql.ErrNoRows {
+		return types.FSCKRun{}, false, nil
+	} else if err != nil {
+		return types.FSCKRun{}, false, err
+	}
+
+	run.Started = time.Unix(0, started)
+	run.Finished = time.Unix(0, finished)
+	return run, true, nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// SetMoleculeLabel sets the label key on the molecule called name to value,
+// replacing any existing value.
+func (db *AtomfsDB) SetMoleculeLabel(name string, key string, value string) error {
+	return db.inTx(func(tx *AtomfsDB) error {
+		result, err := tx.q.Exec(`
+			INSERT OR REPLACE INTO molecule_labels (molecule_id, key, value)
+			SELECT id, ?, ? FROM molecules WHERE name = ? AND deleted_at IS NULL`, key, value, name)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return fmt.Errorf("%w: %s", types.ErrMoleculeNotFound, name)
+		}
+
+		return nil
+	})
+}
+
+// GetMoleculeLabels returns all of the labels on the molecule called name.
+func (db *AtomfsDB) GetMoleculeLabels(name string) (map[string]string, error) {
+	rows, err := db.q.Query(`
+		SELECT molecule_labels.key, molecule_labels.value
+		FROM molecule_labels JOIN molecules ON molecule_labels.molecule_id = molecules.id
+		WHERE molecules.name = ? AND molecules.deleted_at IS NULL`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		labels[key] = value
+	}
+
+	return labels, rows.Err()
+}
+
+// FindMoleculesByLabel returns all of the molecules whose label key is value,
+// with their atoms.
+func (db *AtomfsDB) FindMoleculesByLabel(key string, value string) ([]types.Molecule, error) {
+	rows, err := db.q.Query(`
+		SELECT molecules.id, molecules.name
+		FROM molecules JOIN molecule_labels ON molecules.id = molecule_labels.molecule_id
+		WHERE molecule_labels.key = ? AND molecule_labels.value = ?
+			AND molecules.deleted_at IS NULL
+		ORDER BY molecules.id ASC`, key, value)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return db.getMolecules(rows)
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"time"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// AddMount records that the molecule with id moleculeID is mounted at target,
+// replacing any existing record for target.
+func (db *AtomfsDB) AddMount(target string, moleculeID int64) error {
+	_, err := db.q.Exec(
+		"INSERT OR REPLACE INTO mounts (target, molecule_id, mounted) VALUES (?, ?, ?)",
+		target, moleculeID, time.Now().UTC())
+	return err
+}
+
+// RemoveMount forgets about the mount at target, if there is one.
+func (db *AtomfsDB) RemoveMount(target string) error {
+	_, err := db.q.Exec("DELETE FROM mounts WHERE target = ?", target)
+	return err
+}
+
+// GetMounts returns all of the recorded mounts, oldest first.
+func (db *AtomfsDB) GetMounts() ([]types.Mount, error) {
+	rows, err := db.q.Query(`
+		SELECT mounts.target, molecules.name, mounts.mounted
+		FROM mounts JOIN molecules ON mounts.molecule_id = molecules.id
+		ORDER BY mounts.id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mounts := []types.Mount{}
+	for rows.Next() {
+		m := types.Mount{}
+		if err := rows.Scan(&m.Target, &m.Molecule, &m.Time); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+
+	return mounts, rows.Err()
+}
+
+// IsMoleculeMounted returns true if there is a recorded mount of the molecule
+// with id moleculeID.
+func (db *AtomfsDB) IsMoleculeMounted(moleculeID int64) (bool, error) {
+	mounted := false
+	err := db.q.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM mounts WHERE molecule_id = ?)",
+		moleculeID).Scan(&mounted)
+	return mounted, wrapDBError(err)
+}
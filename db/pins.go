@@ -0,0 +1,48 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// SetAtomPinned pins or unpins the atom with the given hash; see
+// types.Atom.Pinned.
+func (db *AtomfsDB) SetAtomPinned(hash string, pinned bool) error {
+	result, err := db.q.Exec("UPDATE atoms SET pinned = ? WHERE hash = ?", pinned, hash)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: %s", types.ErrAtomNotFound, hash)
+	}
+
+	return nil
+}
+
+// SetMoleculePinned pins or unpins the molecule called name. Pinned molecules
+// are left out of GetEmptyMolecules and GetMoleculesCreatedBefore, so that
+// they aren't collected.
+func (db *AtomfsDB) SetMoleculePinned(name string, pinned bool) error {
+	result, err := db.q.Exec("UPDATE molecules SET pinned = ? WHERE name = ? AND deleted_at IS NULL", pinned, name)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: %s", types.ErrMoleculeNotFound, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/anuvu/atomfs/types"
+	"github.com/mattn/go-sqlite3"
+)
+
+// isBusy reports whether err means that another connection has the db locked,
+// in which case trying again later may work.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+}
+
+// retry calls f until it succeeds, fails with an error that isn't transient,
+// or the config's retry policy runs out of attempts, in which case the error
+// wraps types.ErrLocked.
+func (db *AtomfsDB) retry(f func() error) error {
+	policy := db.config.Retry
+	backoff := policy.InitialBackoff()
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || !isBusy(err) {
+			return err
+		}
+
+		if attempt >= policy.Attempts() {
+			return types.WrapError(types.ErrLocked, "db is busy", err)
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
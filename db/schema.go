@@ -3,18 +3,27 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/anuvu/atomfs/types"
 
 	"github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
 )
 
-var Schema string = `
+// The schema table records every migration that has been applied to the db;
+// the highest version in it is the db's current schema version.
+var schemaTable string = `
 CREATE TABLE IF NOT EXISTS schema (
 	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 	version INTEGER NOT NULL,
 	updated DATETIME NOT NULL
 );
+`
 
+// Schema is the original atomfs schema, i.e. version 1.
+var Schema string = schemaTable + `
 CREATE TABLE IF NOT EXISTS atoms (
 	id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
 	name TEXT NOT NULL,
@@ -40,6 +49,98 @@ CREATE TABLE IF NOT EXISTS molecule_atoms (
 );
 `
 
+// migrations are applied in order to bring a db up to the current schema
+// version; migrations[i] takes the db from version i to version i+1. Never
+// modify an existing migration, only append new ones.
+var migrations = []string{
+	Schema,
+	// 2: atoms may use digest algorithms other than sha256.
+	`ALTER TABLE atoms ADD COLUMN algorithm TEXT NOT NULL DEFAULT 'sha256';`,
+	// 3: atoms may be compressed on disk.
+	`ALTER TABLE atoms ADD COLUMN compression TEXT NOT NULL DEFAULT 'none';`,
+	// 4: molecules can be labeled with arbitrary key/value pairs.
+	`CREATE TABLE IF NOT EXISTS molecule_labels (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		molecule_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		FOREIGN KEY (molecule_id) REFERENCES molecules (id) ON DELETE CASCADE,
+		UNIQUE (molecule_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS molecule_labels_key_value ON molecule_labels (key, value);`,
+	// 5: track which molecules are mounted where.
+	`CREATE TABLE IF NOT EXISTS mounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		target TEXT NOT NULL,
+		molecule_id INTEGER NOT NULL,
+		mounted DATETIME NOT NULL,
+		-- Note: no ON DELETE CASCADE; a mounted molecule can't be
+		-- deleted out from under its mount.
+		FOREIGN KEY (molecule_id) REFERENCES molecules (id),
+		UNIQUE (target)
+	);`,
+	// 6: track when atoms were last used, for LRU eviction. NULL means
+	// the atom hasn't been used since this was added.
+	`ALTER TABLE atoms ADD COLUMN last_used DATETIME;`,
+	// 7: record the size of atoms' files, for quick checks. NULL means
+	// the size isn't known.
+	`ALTER TABLE atoms ADD COLUMN size INTEGER;`,
+	// 8: record when molecules were created, for pruning by age. NULL
+	// means the molecule predates this.
+	`ALTER TABLE molecules ADD COLUMN created DATETIME;`,
+	// 9: remember FSCK results, so that an interrupted FSCK can resume.
+	`CREATE TABLE IF NOT EXISTS fsck_checkpoints (
+		atom_id INTEGER PRIMARY KEY NOT NULL,
+		size INTEGER NOT NULL,
+		mtime INTEGER NOT NULL,
+		ok BOOLEAN NOT NULL,
+		kind INTEGER NOT NULL,
+		error TEXT NOT NULL,
+		checked DATETIME NOT NULL,
+		FOREIGN KEY (atom_id) REFERENCES atoms (id) ON DELETE CASCADE
+	);`,
+	// 10: atoms may be stored as content defined chunks.
+	`ALTER TABLE atoms ADD COLUMN chunked BOOLEAN NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS atom_chunks (
+		atom_id INTEGER NOT NULL,
+		seq INTEGER NOT NULL,
+		hash TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY (atom_id, seq),
+		FOREIGN KEY (atom_id) REFERENCES atoms (id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS atom_chunks_hash ON atom_chunks (hash);`,
+	// 11: remember atoms' OCI media types. NULL means it isn't known.
+	`ALTER TABLE atoms ADD COLUMN media_type TEXT;`,
+	// 12: molecules may be soft deleted. NULL means they aren't.
+	`ALTER TABLE molecules ADD COLUMN deleted_at DATETIME;`,
+	// 13: record the versions of schemas registered by users of atomfs;
+	// see types.ExternalSchema.
+	`CREATE TABLE IF NOT EXISTS external_schema (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		name TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		updated DATETIME NOT NULL
+	);`,
+	// 14: atoms may be encrypted. NULL means they aren't.
+	`ALTER TABLE atoms ADD COLUMN key_id TEXT;`,
+	// 15: atoms and molecules may be pinned, so that GC leaves them be.
+	`ALTER TABLE atoms ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT 0;
+	ALTER TABLE molecules ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT 0;`,
+	// 16: record each completed FSCK. Times are in unix nanoseconds, like
+	// fsck_checkpoints.mtime.
+	`CREATE TABLE IF NOT EXISTS fsck_runs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		started INTEGER NOT NULL,
+		finished INTEGER NOT NULL,
+		atoms INTEGER NOT NULL,
+		errors INTEGER NOT NULL
+	);`,
+}
+
+// CurrentVersion is the schema version that this version of atomfs uses.
+var CurrentVersion = len(migrations)
+
 func init() {
 	sql.Register("sqlite3_with_fk", &sqlite3.SQLiteDriver{ConnectHook: sqliteEnableForeignKeys})
 }
@@ -49,16 +150,113 @@ func sqliteEnableForeignKeys(conn *sqlite3.SQLiteConn) error {
 	return err
 }
 
-func openSqlite(path string) (*sql.DB, error) {
-	openPath := fmt.Sprintf("%s?_busy_timeout=5&_txlock=exclusive", path)
+// sqliteOptions renders opts as go-sqlite3 DSN parameters, which it applies as
+// pragmas to each new connection.
+func sqliteOptions(opts types.SQLiteOptions, readOnly bool) string {
+	timeout := opts.BusyTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	params := []string{fmt.Sprintf("_busy_timeout=%d", timeout/time.Millisecond)}
+
+	if !readOnly {
+		if opts.JournalMode != "" {
+			params = append(params, "_journal_mode="+opts.JournalMode)
+		}
+
+		if opts.AutoVacuum != "" {
+			params = append(params, "_auto_vacuum="+strings.ToLower(opts.AutoVacuum))
+		}
+	}
+
+	if opts.Synchronous != "" {
+		params = append(params, "_synchronous="+opts.Synchronous)
+	}
+
+	return strings.Join(params, "&")
+}
+
+func openSqlite(path string, opts types.SQLiteOptions) (*sql.DB, error) {
+	openPath := fmt.Sprintf("%s?%s&_txlock=exclusive", path, sqliteOptions(opts, false))
+	db, err := sql.Open("sqlite3_with_fk", openPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func schemaVersion(q querier) (int, error) {
+	version := 0
+	err := q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema").Scan(&version)
+	return version, err
+}
+
+// migrate brings the db's schema up to CurrentVersion in a single
+// transaction, so a crash never leaves a half migrated db. It refuses to
+// touch a db that is newer than this version of atomfs understands.
+func migrate(db *sql.DB) error {
+	_, err := db.Exec(schemaTable)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create schema table")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't get schema version")
+	}
+
+	if version > CurrentVersion {
+		return errors.Errorf("db schema version %d is newer than this atomfs supports (%d)", version, CurrentVersion)
+	}
+
+	for ; version < CurrentVersion; version++ {
+		_, err = tx.Exec(migrations[version])
+		if err != nil {
+			return errors.Wrapf(err, "couldn't migrate schema to version %d", version+1)
+		}
+
+		_, err = tx.Exec("INSERT INTO schema (version, updated) VALUES (?, datetime('now'))", version+1)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't record schema version %d", version+1)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// openSqliteReadOnly opens an existing db without ever writing to it. Since
+// the store can't be modified, we don't try to create or migrate the schema.
+func openSqliteReadOnly(path string, opts types.SQLiteOptions) (*sql.DB, error) {
+	openPath := fmt.Sprintf("file:%s?mode=ro&%s", path, sqliteOptions(opts, true))
 	db, err := sql.Open("sqlite3_with_fk", openPath)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec(Schema)
+	// We can't migrate a read only db, so it must already be exactly the
+	// version we expect.
+	version, err := schemaVersion(db)
 	if err != nil {
-		return nil, errors.Wrapf(err, "couldn't create schema")
+		db.Close()
+		return nil, errors.Wrapf(err, "couldn't get schema version")
+	}
+
+	if version != CurrentVersion {
+		db.Close()
+		return nil, errors.Errorf("db schema version %d doesn't match this atomfs (%d); open it read-write to migrate it", version, CurrentVersion)
 	}
 
 	return db, nil
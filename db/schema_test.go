@@ -1,12 +1,93 @@
 package db
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"testing"
+
+	"github.com/anuvu/atomfs/types"
 )
 
 func TestCreateSchema(t *testing.T) {
-	_, err := openSqlite(":memory:")
+	_, err := openSqlite(":memory:", types.SQLiteOptions{})
+	if err != nil {
+		t.Fatalf("couldn't create schema: %s", err)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-schema-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := path.Join(dir, "atomfs.db")
+	db, err := openSqlite(dbPath, types.SQLiteOptions{})
 	if err != nil {
 		t.Fatalf("couldn't create schema: %s", err)
 	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		t.Fatalf("couldn't get schema version: %s", err)
+	}
+
+	if version != CurrentVersion {
+		t.Fatalf("bad schema version %d, expected %d", version, CurrentVersion)
+	}
+
+	_, err = db.Exec("INSERT INTO schema (version, updated) VALUES (?, datetime('now'))", CurrentVersion+1)
+	db.Close()
+	if err != nil {
+		t.Fatalf("couldn't bump schema version: %s", err)
+	}
+
+	_, err = openSqlite(dbPath, types.SQLiteOptions{})
+	if err == nil {
+		t.Fatalf("opened a db with a newer schema")
+	}
+}
+
+func TestExternalSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-schema-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	schema := types.ExternalSchema{
+		Name:       "test",
+		Migrations: []string{"CREATE TABLE test_builds (molecule_id INTEGER NOT NULL, build TEXT NOT NULL);"},
+	}
+
+	config := types.Config{Path: dir, ExternalSchemas: []types.ExternalSchema{schema}}
+	db, err := New(config)
+	if err != nil {
+		t.Fatalf("couldn't open db: %s", err)
+	}
+
+	if _, err := db.Exec("INSERT INTO test_builds (molecule_id, build) VALUES (1, 'foo')"); err != nil {
+		t.Fatalf("couldn't use external table: %s", err)
+	}
+	db.Close()
+
+	// Opening it again mustn't run the migration again.
+	schema.Migrations = append(schema.Migrations, "ALTER TABLE test_builds ADD COLUMN started DATETIME;")
+	config.ExternalSchemas = []types.ExternalSchema{schema}
+	db, err = New(config)
+	if err != nil {
+		t.Fatalf("couldn't reopen db: %s", err)
+	}
+	defer db.Close()
+
+	version, err := externalSchemaVersion(db.DB, "test")
+	if err != nil {
+		t.Fatalf("couldn't get external schema version: %s", err)
+	}
+
+	if version != 2 {
+		t.Fatalf("bad external schema version %d, expected 2", version)
+	}
 }
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// connQuerier runs queries on a single connection, so that they're all part
+// of the transaction that was begun on it.
+type connQuerier struct {
+	ctx  context.Context
+	conn *sql.Conn
+}
+
+func (q connQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return q.conn.ExecContext(q.ctx, query, args...)
+}
+
+func (q connQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return q.conn.QueryContext(q.ctx, query, args...)
+}
+
+func (q connQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	return q.conn.QueryRowContext(q.ctx, query, args...)
+}
+
+func (q connQuerier) Prepare(query string) (*sql.Stmt, error) {
+	return q.conn.PrepareContext(q.ctx, query)
+}
+
+// Snapshot returns an AtomfsDB whose queries all see the db as it was when
+// Snapshot was called, however it is changed afterwards. The caller must call
+// Release() on the result.
+//
+// The db is opened with _txlock=exclusive, which Begin() relies on, so the
+// snapshot's read transaction is begun by hand on a connection of its own.
+// In WAL mode (see types.SQLiteOptions) it doesn't hold up any writers, but in
+// the other journal modes, writers can't commit until it is released.
+func (db *AtomfsDB) Snapshot() (*AtomfsDB, error) {
+	if db.tx != nil || db.snapshot != nil {
+		return nil, errors.Errorf("already in a transaction")
+	}
+
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := errQuerier{connQuerier{ctx, conn}}
+	if _, err := q.Exec("BEGIN DEFERRED"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// A deferred transaction doesn't pick which version of the db it
+	// sees until it first reads from it.
+	if _, err := schemaVersion(q); err != nil {
+		q.Exec("ROLLBACK")
+		conn.Close()
+		return nil, err
+	}
+
+	return &AtomfsDB{DB: db.DB, config: db.config, storage: db.storage, q: q, snapshot: conn}, nil
+}
+
+// Release ends a snapshot started by Snapshot().
+func (db *AtomfsDB) Release() error {
+	if db.snapshot == nil {
+		return errors.Errorf("not a snapshot")
+	}
+
+	_, err := db.q.Exec("ROLLBACK")
+	if cErr := db.snapshot.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// InSnapshot runs f with a snapshot of the db (see Snapshot()), so that all of
+// its queries see the same version of it. If db is already a transaction or a
+// snapshot, f just runs inside of it.
+func (db *AtomfsDB) InSnapshot(f func(*AtomfsDB) error) error {
+	if db.tx != nil || db.snapshot != nil {
+		return f(db)
+	}
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	err = f(snap)
+	if rErr := snap.Release(); err == nil {
+		err = rErr
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// querier is the subset of *sql.DB and *sql.Tx that the AtomfsDB methods use,
+// so that they work the same way inside and outside of a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+// Begin starts a transaction, returning an AtomfsDB whose methods all operate
+// inside of it. The caller must call Commit() or Rollback() on the result.
+func (db *AtomfsDB) Begin() (*AtomfsDB, error) {
+	if db.tx != nil || db.snapshot != nil {
+		return nil, errors.Errorf("already in a transaction")
+	}
+
+	// The db is opened with _txlock=exclusive, so this is where we wait
+	// for other writers; once we have the transaction, nobody else can
+	// make us fail with SQLITE_BUSY.
+	var tx *sql.Tx
+	err := db.retry(func() error {
+		var err error
+		tx, err = db.DB.Begin()
+		return wrapDBError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &AtomfsDB{DB: db.DB, config: db.config, storage: db.storage, q: errQuerier{tx}, tx: tx}, nil
+}
+
+func (db *AtomfsDB) Commit() error {
+	if db.tx == nil {
+		return errors.Errorf("not in a transaction")
+	}
+	return wrapDBError(db.tx.Commit())
+}
+
+func (db *AtomfsDB) Rollback() error {
+	if db.tx == nil {
+		return errors.Errorf("not in a transaction")
+	}
+	return wrapDBError(db.tx.Rollback())
+}
+
+// inTx runs f inside a transaction, committing it if f succeeds and rolling
+// it back otherwise. If db is already a transaction (or a snapshot), f just
+// runs inside of it.
+func (db *AtomfsDB) inTx(f func(*AtomfsDB) error) error {
+	if db.tx != nil || db.snapshot != nil {
+		return f(db)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,103 @@
+package atomfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// DedupAtoms finds atoms whose (uncompressed) contents are byte for byte
+// identical, e.g. because they were imported with different digest algorithms,
+// and collapses each set of them into one canonical atom (the oldest one).
+// Molecules that referenced a duplicate are rewritten to reference the
+// canonical atom, and the duplicates are deleted from the db and from disk.
+// Mounted and pinned duplicates are left alone. It returns the digests of the
+// duplicates; if dryRun is true nothing is changed, but the duplicates that
+// would have been collapsed are still returned.
+func (atomfs *Instance) DedupAtoms(dryRun bool) ([]string, error) {
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	// Atoms come out of the db oldest first, so the first atom with some
+	// content is the canonical one.
+	canonical := map[string]types.Atom{}
+	duplicates := [][2]types.Atom{}
+
+	err = atomfs.db.ForEachAtom(func(atom types.Atom) error {
+		// Chunked atoms already share whatever they can.
+		if atom.Chunked {
+			return nil
+		}
+
+		// Hash everything with the same algorithm, so that atoms
+		// named with different ones can be compared.
+		content, err := atomfs.hashAtom(atom, types.SHA256)
+		if errors.Is(err, os.ErrNotExist) {
+			// Missing atoms are FSCK's problem, not ours.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("couldn't hash atom %s: %w", atom.Hash, err)
+		}
+
+		first, ok := canonical[content]
+		if !ok {
+			canonical[content] = atom
+			return nil
+		}
+
+		// Replacing a pinned atom would delete it, so leave those
+		// alone too.
+		if mounted[atom.Hash] || atom.Pinned {
+			return nil
+		}
+
+		duplicates = append(duplicates, [2]types.Atom{atom, first})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	collapsed := []string{}
+	for _, pair := range duplicates {
+		dup, first := pair[0], pair[1]
+
+		collapsed = append(collapsed, dup.Digest().String())
+		if dryRun {
+			continue
+		}
+
+		if err := atomfs.db.ReplaceAtom(dup.ID, first.ID); err != nil {
+			return collapsed, err
+		}
+
+		// Two atom rows could share a file if they were created by an
+		// old atomfs, so don't delete the canonical atom's.
+		if dup.FileName() != first.FileName() {
+			err := atomfs.storage.Remove(dup.FileName())
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return collapsed, err
+			}
+		}
+
+		atomfs.log().Debug("collapsed duplicate atom", "hash", dup.Hash, "into", first.Hash)
+	}
+
+	return collapsed, nil
+}
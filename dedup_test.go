@@ -0,0 +1,88 @@
+package atomfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestDedupAtoms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-dedup-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	// The same content under two digest algorithms is two atoms.
+	importBoth := func(content string) (types.Atom, types.Atom) {
+		first, err := atomfs.ImportAtomWithAlgorithm(strings.NewReader(content), types.SHA256)
+		if err != nil {
+			t.Fatalf("couldn't import atom %s", err)
+		}
+
+		dup, err := atomfs.ImportAtomWithAlgorithm(strings.NewReader(content), types.SHA512)
+		if err != nil {
+			t.Fatalf("couldn't import atom %s", err)
+		}
+
+		return first, dup
+	}
+
+	foo, fooDup := importBoth("foo")
+	_, barDup := importBoth("bar")
+
+	if _, err := atomfs.CreateMolecule("foo", []types.Atom{fooDup}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if err := atomfs.PinAtom(barDup.Hash); err != nil {
+		t.Fatalf("couldn't pin atom %s", err)
+	}
+
+	collapsed, err := atomfs.DedupAtoms(true)
+	if err != nil {
+		t.Fatalf("couldn't dedup %s", err)
+	}
+
+	if len(collapsed) != 1 || collapsed[0] != fooDup.Digest().String() {
+		t.Fatalf("expected only the unpinned duplicate to be collapsed, got %v", collapsed)
+	}
+
+	if ok, err := atomfs.HasAtom(fooDup.Hash); err != nil || !ok {
+		t.Fatalf("dry run dedup deleted an atom: %v %v", ok, err)
+	}
+
+	if _, err := atomfs.DedupAtoms(false); err != nil {
+		t.Fatalf("couldn't dedup %s", err)
+	}
+
+	mol, err := atomfs.GetMolecule("foo")
+	if err != nil {
+		t.Fatalf("couldn't get molecule %s", err)
+	}
+
+	if len(mol.Atoms) != 1 || mol.Atoms[0].Hash != foo.Hash {
+		t.Fatalf("molecule wasn't rewritten to the canonical atom: %v", mol.Atoms)
+	}
+
+	if ok, err := atomfs.HasAtom(fooDup.Hash); err != nil || ok {
+		t.Fatalf("duplicate atom wasn't deleted: %v %v", ok, err)
+	}
+
+	if _, err := atomfs.storage.Stat(fooDup.FileName()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("duplicate atom's file wasn't removed: %v", err)
+	}
+
+	if ok, err := atomfs.HasAtom(barDup.Hash); err != nil || !ok {
+		t.Fatalf("pinned duplicate atom was deleted: %v %v", ok, err)
+	}
+}
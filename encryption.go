@@ -0,0 +1,83 @@
+package atomfs
+
+import (
+	"fmt"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// ErrAtomEncrypted is returned (wrapped) when an encrypted atom would have to
+// be used as a plain file, e.g. to mount or export it. It is the same error as
+// types.ErrAtomEncrypted.
+var ErrAtomEncrypted = types.ErrAtomEncrypted
+
+// checkNotEncrypted fails with an error wrapping ErrAtomEncrypted if any of the
+// molecule called name's atoms are encrypted.
+func checkNotEncrypted(name string, atoms []types.Atom) error {
+	encrypted := []string{}
+	for _, atom := range atoms {
+		if atom.KeyID != "" {
+			encrypted = append(encrypted, atom.Hash)
+		}
+	}
+
+	if len(encrypted) > 0 {
+		return fmt.Errorf("%w: %s uses encrypted atoms %v", ErrAtomEncrypted, name, encrypted)
+	}
+
+	return nil
+}
+
+// RekeyAtoms rewrites the files of any atoms that aren't encrypted with the
+// current key of types.Config.Encrypter, e.g. after it has been rotated, or if
+// the store predates it. If there is no Encrypter, encrypted atoms are
+// decrypted instead. Chunked and mounted atoms are left alone. It returns the
+// atoms that were rewritten.
+//
+// The Encrypter must still be able to decrypt atoms with the old keys; once
+// this succeeds, they aren't needed any more.
+func (atomfs *Instance) RekeyAtoms() ([]types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	// Readers of an atom mustn't see its file change out from under the
+	// key id they read from the db.
+	unlock, err := atomfs.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := ""
+	if atomfs.config.Encrypter != nil {
+		keyID = atomfs.config.Encrypter.KeyID()
+	}
+
+	atoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	rekeyed := []types.Atom{}
+	for _, atom := range atoms {
+		if atom.KeyID == keyID || atom.Chunked || mounted[atom.Hash] {
+			continue
+		}
+
+		fixed, err := atomfs.db.RekeyAtom(atom)
+		if err != nil {
+			return rekeyed, fmt.Errorf("couldn't rekey atom %s: %w", atom.Hash, err)
+		}
+
+		atomfs.log().Info("rekeyed atom", "hash", fixed.Hash, "key", fixed.KeyID)
+		rekeyed = append(rekeyed, fixed)
+	}
+
+	return rekeyed, nil
+}
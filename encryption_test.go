@@ -0,0 +1,112 @@
+package atomfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// xorEncrypter "encrypts" by xoring each byte with the first byte of its key
+// id, which is plenty to tell whether the right key was used.
+type xorEncrypter struct {
+	keyID string
+}
+
+func (e xorEncrypter) KeyID() string {
+	return e.keyID
+}
+
+func (e xorEncrypter) Encrypt(w io.Writer) (io.WriteCloser, error) {
+	return xorWriter{w, e.keyID[0]}, nil
+}
+
+func (e xorEncrypter) Decrypt(keyID string, r io.Reader) (io.Reader, error) {
+	return xorReader{r, keyID[0]}, nil
+}
+
+type xorWriter struct {
+	w   io.Writer
+	key byte
+}
+
+func (x xorWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, len(p))
+	for i := range p {
+		buf[i] = p[i] ^ x.key
+	}
+	return x.w.Write(buf)
+}
+
+func (x xorWriter) Close() error {
+	return nil
+}
+
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= x.key
+	}
+	return n, err
+}
+
+func TestRekeyAtoms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-encryption-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir, Encrypter: xorEncrypter{"a"}})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	atom, err := atomfs.ImportAtom(strings.NewReader("secret"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	if atom.KeyID != "a" {
+		t.Fatalf("atom was encrypted with key %q", atom.KeyID)
+	}
+
+	if content := readAtom(t, atomfs, atom); string(content) != "secret" {
+		t.Fatalf("encrypted atom reads back as %q", content)
+	}
+
+	if err := atomfs.Close(); err != nil {
+		t.Fatalf("couldn't close atomfs %s", err)
+	}
+
+	atomfs, err = New(types.Config{Path: dir, Encrypter: xorEncrypter{"b"}})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	rekeyed, err := atomfs.RekeyAtoms()
+	if err != nil {
+		t.Fatalf("couldn't rekey atoms %s", err)
+	}
+
+	if len(rekeyed) != 1 || rekeyed[0].KeyID != "b" {
+		t.Fatalf("expected the atom to be rekeyed with b, got %v", rekeyed)
+	}
+
+	if content := readAtom(t, atomfs, rekeyed[0]); string(content) != "secret" {
+		t.Fatalf("rekeyed atom reads back as %q", content)
+	}
+
+	if _, err := atomfs.storage.Stat(atom.FileName()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file for the old key is still there: %v", err)
+	}
+}
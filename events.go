@@ -0,0 +1,53 @@
+package atomfs
+
+import (
+	"time"
+)
+
+// EventOp is the kind of change an Event describes.
+type EventOp string
+
+const (
+	MoleculeCreated EventOp = "created"
+	MoleculeCopied  EventOp = "copied"
+	MoleculeRenamed EventOp = "renamed"
+	MoleculeUpdated EventOp = "updated"
+	MoleculeDeleted EventOp = "deleted"
+	// MoleculeRestored is for a soft deleted molecule that was restored;
+	// see types.Config.DeleteGracePeriod.
+	MoleculeRestored EventOp = "restored"
+)
+
+// Event describes a change to a molecule.
+type Event struct {
+	Op EventOp
+	// Molecule is the name of the molecule that was changed. For copies
+	// and renames, it is the new name.
+	Molecule string
+	// Source is the name of the molecule that was copied or renamed, and
+	// is empty for other events.
+	Source string
+	Time   time.Time
+}
+
+// SetEventHandler sets a function that is called after each change to a
+// molecule has been committed to the db. Passing nil disables events. The
+// handler is called synchronously, so it should not block for long. This
+// should be called before the Instance is used concurrently.
+func (atomfs *Instance) SetEventHandler(handler func(ev Event)) {
+	atomfs.eventHandler = handler
+}
+
+func (atomfs *Instance) emit(op EventOp, molecule string, source string) {
+	if atomfs.eventHandler == nil {
+		return
+	}
+
+	ev := Event{op, molecule, source, time.Now()}
+	if atomfs.pendingEvents != nil {
+		*atomfs.pendingEvents = append(*atomfs.pendingEvents, ev)
+		return
+	}
+
+	atomfs.eventHandler(ev)
+}
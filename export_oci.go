@@ -0,0 +1,502 @@
+package atomfs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/anuvu/atomfs/storage"
+	"github.com/anuvu/atomfs/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// squashfs layers aren't in the OCI spec, but stacker uses this media type.
+const mediaTypeLayerSquashfs = "application/vnd.oci.image.layer.squashfs"
+
+// mediaTypeLayerZstd is the OCI media type of zstd compressed tar layers,
+// which is newer than the image-spec we use.
+const mediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+// ExportOCI writes the molecule as an image in the OCI layout at dir, tagged
+// with the molecule's name. The layout is created if it doesn't exist; if it
+// does, the image is added to it, replacing any existing image with the same
+// tag.
+func (atomfs *Instance) ExportOCI(molecule string, dir string) error {
+	return atomfs.ExportOCIAs(molecule, dir, molecule)
+}
+
+// ExportOCIAs is like ExportOCI, but tags the image with tag rather than the
+// molecule's name.
+func (atomfs *Instance) ExportOCIAs(molecule string, dir string, tag string) error {
+	// Hold the lock so that GC can't remove any reassembled chunked atoms
+	// before they're exported.
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mol, err := atomfs.ociExportMolecule(molecule)
+	if err != nil {
+		return err
+	}
+
+	for _, atom := range mol.Atoms {
+		alg := string(atom.Digest().Algorithm)
+		if err := os.MkdirAll(path.Join(dir, "blobs", alg), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(path.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		return err
+	}
+
+	layout, err := json.Marshal(ispec.ImageLayout{Version: ispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, ispec.ImageLayoutFile), layout, 0644)
+	if err != nil {
+		return err
+	}
+
+	config, manifest, err := ociImage(mol, func(atom types.Atom) (ispec.Descriptor, digest.Digest, error) {
+		return atomfs.exportAtomBlob(atom, dir)
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest.Config, err = writeJSONBlob(dir, ispec.MediaTypeImageConfig, config)
+	if err != nil {
+		return err
+	}
+
+	manifestDesc, err := writeJSONBlob(dir, ispec.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{ispec.AnnotationRefName: tag}
+
+	if err := addToOCIIndex(dir, manifestDesc); err != nil {
+		return err
+	}
+
+	if atomfs.config.ReadOnly {
+		return nil
+	}
+
+	return atomfs.db.TouchAtoms(mol.Atoms)
+}
+
+// ExportOCIStream is like ExportOCI, but rather than writing an OCI layout,
+// it calls blob for each of the image's blobs (the layers, bottom most first,
+// then the config, then the manifest) and writes the blob to the writer it
+// returns, which it then closes. If blob returns a nil writer, that blob is
+// skipped, e.g. because the destination already has it. It returns the
+// manifest's descriptor, annotated with the molecule's name like ExportOCI's
+// tag.
+//
+// Each layer is copied straight from its atom's file, so this needs no
+// scratch space, however big the molecule is. Some atoms (e.g. gzipped ones)
+// are read once before they are copied, to work out their digests.
+func (atomfs *Instance) ExportOCIStream(molecule string, blob func(desc ispec.Descriptor) (io.WriteCloser, error)) (ispec.Descriptor, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+	defer unlock()
+
+	mol, err := atomfs.ociExportMolecule(molecule)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	config, manifest, err := ociImage(mol, func(atom types.Atom) (ispec.Descriptor, digest.Digest, error) {
+		desc, diffID, err := atomfs.atomBlobDescriptor(atom)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+
+		f, err := atomfs.storage.Open(atom.FileName())
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+		defer f.Close()
+
+		return desc, diffID, streamBlob(blob, desc, f)
+	})
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	content, configDesc, err := jsonBlob(ispec.MediaTypeImageConfig, config)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := streamBlob(blob, configDesc, bytes.NewReader(content)); err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	manifest.Config = configDesc
+	content, manifestDesc, err := jsonBlob(ispec.MediaTypeImageManifest, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	if err := streamBlob(blob, manifestDesc, bytes.NewReader(content)); err != nil {
+		return ispec.Descriptor{}, err
+	}
+	manifestDesc.Annotations = map[string]string{ispec.AnnotationRefName: mol.Name}
+
+	if atomfs.config.ReadOnly {
+		return manifestDesc, nil
+	}
+
+	return manifestDesc, atomfs.db.TouchAtoms(mol.Atoms)
+}
+
+// ociExportMolecule returns the molecule called name, once its atoms are
+// ready to be exported as OCI blobs.
+func (atomfs *Instance) ociExportMolecule(name string) (types.Molecule, error) {
+	mol, err := atomfs.db.GetMolecule(name)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	if err := checkNotEncrypted(name, mol.Atoms); err != nil {
+		return types.Molecule{}, err
+	}
+
+	if err := atomfs.reassembleAtoms(mol.Atoms); err != nil {
+		return types.Molecule{}, err
+	}
+
+	return mol, nil
+}
+
+// streamBlob copies the blob described by desc from r to the writer that blob
+// returns for it, if any.
+func streamBlob(blob func(desc ispec.Descriptor) (io.WriteCloser, error), desc ispec.Descriptor, r io.Reader) error {
+	w, err := blob(desc)
+	if err != nil || w == nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// ociImage returns the config and manifest (without its config descriptor) of
+// an image of mol, calling layer to export each of its atoms as a layer and
+// get its descriptor and diff id.
+func ociImage(mol types.Molecule, layer func(atom types.Atom) (ispec.Descriptor, digest.Digest, error)) (ispec.Image, ispec.Manifest, error) {
+	config := ispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           "linux",
+		RootFS:       ispec.RootFS{Type: "layers"},
+	}
+	manifest := ispec.Manifest{}
+	manifest.SchemaVersion = 2
+
+	// atomfs keeps the top most layer first, but OCI wants the bottom
+	// most layer first.
+	for i := len(mol.Atoms) - 1; i >= 0; i-- {
+		atom := mol.Atoms[i]
+
+		desc, diffID, err := layer(atom)
+		if err != nil {
+			return ispec.Image{}, ispec.Manifest{}, errors.Wrapf(err, "couldn't export atom %s", atom.Hash)
+		}
+
+		manifest.Layers = append(manifest.Layers, desc)
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+	}
+
+	return config, manifest, nil
+}
+
+// exportAtomBlob puts the atom's file into dir's blob store, returning its
+// descriptor and the digest of its uncompressed contents.
+func (atomfs *Instance) exportAtomBlob(atom types.Atom, dir string) (ispec.Descriptor, digest.Digest, error) {
+	desc, diffID, err := atomfs.atomBlobDescriptor(atom)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	blob := path.Join(dir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := atomfs.linkOrCopy(atom.FileName(), blob); err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+	} else if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	return desc, diffID, nil
+}
+
+// atomBlobDescriptor returns the descriptor of the blob that is the atom's
+// file, and the digest of its uncompressed contents.
+func (atomfs *Instance) atomBlobDescriptor(atom types.Atom) (ispec.Descriptor, digest.Digest, error) {
+	source := atom.FileName()
+	alg := atom.Digest().Algorithm
+
+	// A compressed atom's hash is that of its uncompressed content, so the
+	// blob (which is the compressed file) has a digest of its own.
+	blobHash := atom.Hash
+	if atom.Compression != "" && atom.Compression != types.NoCompression {
+		if atom.Compression != types.GzipCompression && atom.Compression != types.ZstdCompression {
+			return ispec.Descriptor{}, "", errors.Errorf("can't export %s atoms", atom.Compression)
+		}
+
+		var err error
+		blobHash, err = atomfs.hashAtomFile(source, alg)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+	}
+
+	fi, err := atomfs.storage.Stat(source)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	desc := ispec.Descriptor{
+		Digest: digest.NewDigestFromEncoded(digest.Algorithm(alg), blobHash),
+		Size:   fi.Size,
+	}
+	diffID := desc.Digest
+
+	switch atom.Type {
+	case types.SquashfsAtom:
+		desc.MediaType = mediaTypeLayerSquashfs
+	case types.TarAtom:
+		switch atom.Compression {
+		case types.GzipCompression:
+			desc.MediaType = ispec.MediaTypeImageLayerGzip
+			diffID = digest.NewDigestFromEncoded(digest.Algorithm(alg), atom.Hash)
+			return desc, diffID, nil
+		case types.ZstdCompression:
+			desc.MediaType = mediaTypeLayerZstd
+			diffID = digest.NewDigestFromEncoded(digest.Algorithm(alg), atom.Hash)
+			return desc, diffID, nil
+		}
+
+		// The blob is the content as it was imported, so it has the
+		// media type it was imported with, if we know it.
+		desc.MediaType = ociLayerMediaType(atom.MediaType)
+		gzipped := strings.HasSuffix(desc.MediaType, "+gzip")
+		if desc.MediaType == "" {
+			var err error
+			gzipped, err = atomfs.isGzipped(source)
+			if err != nil {
+				return ispec.Descriptor{}, "", err
+			}
+
+			desc.MediaType = ispec.MediaTypeImageLayer
+			if gzipped {
+				desc.MediaType = ispec.MediaTypeImageLayerGzip
+			}
+		}
+
+		if !gzipped {
+			break
+		}
+
+		var err error
+		diffID, err = atomfs.gunzippedDigest(source)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+	default:
+		return ispec.Descriptor{}, "", errors.Errorf("unknown atom type %s", atom.Type)
+	}
+
+	return desc, diffID, nil
+}
+
+// ociLayerMediaType is the OCI media type for a tar layer with the given media
+// type, which may be one of Docker's, or "" if mediaType isn't a tar layer type
+// that we know.
+func ociLayerMediaType(mediaType string) string {
+	switch mediaType {
+	case mediaTypeDockerLayer:
+		return ispec.MediaTypeImageLayerGzip
+	case mediaTypeDockerForeignLayer:
+		return ispec.MediaTypeImageLayerNonDistributableGzip
+	case ispec.MediaTypeImageLayer, ispec.MediaTypeImageLayerGzip,
+		ispec.MediaTypeImageLayerNonDistributable, ispec.MediaTypeImageLayerNonDistributableGzip:
+		return mediaType
+	default:
+		return ""
+	}
+}
+
+// isGzipped reports whether the atom file called name is gzipped.
+func (atomfs *Instance) isGzipped(name string) (bool, error) {
+	f, err := atomfs.storage.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic, err := bufio.NewReader(f).Peek(2)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// gunzippedDigest returns the sha256 digest of the gunzipped contents of the
+// atom file called name.
+func (atomfs *Instance) gunzippedDigest(name string) (digest.Digest, error) {
+	f, err := atomfs.storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, gz); err != nil {
+		return "", err
+	}
+
+	return digest.NewDigestFromEncoded(digest.SHA256, fmt.Sprintf("%x", h.Sum(nil))), nil
+}
+
+// hashAtomFile returns the hash of the (raw, possibly compressed) atom file
+// called name, computed with alg.
+func (atomfs *Instance) hashAtomFile(name string, alg types.DigestAlgorithm) (string, error) {
+	f, err := atomfs.storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return alg.HashReader(f)
+}
+
+// linkOrCopy hardlinks the atom file called name to dest if possible, and
+// copies it otherwise (e.g. if they're on different filesystems, or the atom
+// isn't in local storage).
+func (atomfs *Instance) linkOrCopy(name string, dest string) error {
+	if local, ok := atomfs.storage.(*storage.Local); ok {
+		if err := os.Link(local.Path(name), dest); err == nil {
+			return nil
+		}
+	}
+
+	in, err := atomfs.storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(path.Dir(dest), storage.TempPrefix)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	return os.Rename(out.Name(), dest)
+}
+
+func writeJSONBlob(dir string, mediaType string, thing interface{}) (ispec.Descriptor, error) {
+	content, desc, err := jsonBlob(mediaType, thing)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "blobs", "sha256", desc.Digest.Encoded()), content, 0644)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// jsonBlob returns thing as a JSON blob, and its descriptor.
+func jsonBlob(mediaType string, thing interface{}) ([]byte, ispec.Descriptor, error) {
+	content, err := json.Marshal(thing)
+	if err != nil {
+		return nil, ispec.Descriptor{}, err
+	}
+
+	d := digest.FromBytes(content)
+	return content, ispec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(content))}, nil
+}
+
+// addToOCIIndex adds desc to dir's index.json, replacing any existing
+// manifest with the same tag.
+func addToOCIIndex(dir string, desc ispec.Descriptor) error {
+	indexPath := path.Join(dir, "index.json")
+	index := ispec.Index{}
+	index.SchemaVersion = 2
+
+	content, err := ioutil.ReadFile(indexPath)
+	if err == nil {
+		if err := json.Unmarshal(content, &index); err != nil {
+			return errors.Wrapf(err, "couldn't parse %s", indexPath)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	manifests := []ispec.Descriptor{}
+	for _, m := range index.Manifests {
+		if m.Annotations[ispec.AnnotationRefName] != desc.Annotations[ispec.AnnotationRefName] {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = append(manifests, desc)
+
+	content, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(indexPath, content, 0644)
+}
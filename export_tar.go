@@ -0,0 +1,259 @@
+package atomfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/anuvu/atomfs/mount"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// ExportTar writes the molecule's merged filesystem to w as a single tar
+// archive, for tools that don't understand layers.
+//
+// The molecule is mounted to get at its atoms, but the layers are merged here
+// rather than by reading the overlay, since overlayfs doesn't understand the
+// OCI whiteouts (.wh. files) that tar atoms use. Whiteouts of both kinds are
+// resolved, so files deleted by an upper layer don't appear in the output.
+func (atomfs *Instance) ExportTar(molecule string, w io.Writer) (err error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	mol, err := atomfs.db.GetMolecule(molecule)
+	if err != nil {
+		return err
+	}
+
+	_, missing, err := atomfs.PreviewMolecule(atomHashes(mol.Atoms))
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: can't export %s, missing %v", ErrAtomMissing, molecule, missing)
+	}
+
+	if err := checkNotEncrypted(molecule, mol.Atoms); err != nil {
+		return err
+	}
+
+	if err := atomfs.reassembleAtoms(mol.Atoms); err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "atomfs-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	ovl, err := mount.NewOverlay(atomfs.config, mol, false)
+	if err != nil {
+		return err
+	}
+
+	if err := ovl.Mount(dir, false); err != nil {
+		return err
+	}
+	defer func() {
+		if uErr := mount.Umount(atomfs.config, dir); uErr != nil && err == nil {
+			err = uErr
+		}
+	}()
+
+	tw := tar.NewWriter(w)
+	f := &tarFlattener{
+		tw:      tw,
+		emitted: map[string]bool{},
+		deleted: map[string]bool{},
+		opaque:  map[string]bool{},
+	}
+
+	// The first atom is the top most layer, which wins.
+	for _, atom := range mol.Atoms {
+		if err := f.addLayer(atomfs.config.MountedAtomsPath(atom.Hash)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if atomfs.config.ReadOnly {
+		return nil
+	}
+
+	return atomfs.db.TouchAtoms(mol.Atoms)
+}
+
+// tarFlattener merges layers into a single tar archive. Layers are added top
+// most first, so the first version of a path that is seen is the one that
+// wins.
+type tarFlattener struct {
+	tw *tar.Writer
+	// emitted are the paths that have been written so far, mapped to
+	// whether they are directories.
+	emitted map[string]bool
+	// deleted are paths that an upper layer whited out; neither they nor
+	// anything under them come from lower layers.
+	deleted map[string]bool
+	// opaque are directories that an upper layer made opaque; nothing
+	// under them comes from lower layers.
+	opaque map[string]bool
+}
+
+func (f *tarFlattener) addLayer(root string) error {
+	// Whiteouts only apply to the layers below this one, so don't apply
+	// them until it's done.
+	whiteouts := []string{}
+	opaques := []string{}
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		base := filepath.Base(rel)
+		switch {
+		case base == opaqueWhiteout:
+			opaques = append(opaques, filepath.Dir(rel))
+			return nil
+		case strings.HasPrefix(base, whiteoutPrefix):
+			whiteouts = append(whiteouts, filepath.Join(filepath.Dir(rel), strings.TrimPrefix(base, whiteoutPrefix)))
+			return nil
+		case isWhiteoutDevice(info):
+			whiteouts = append(whiteouts, rel)
+			return nil
+		}
+
+		if f.hidden(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if isDir, ok := f.emitted[rel]; ok {
+			// An upper layer's non-directory hides anything a
+			// lower layer has under it; an upper layer's directory
+			// is merged with this one.
+			if !isDir && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		f.emitted[rel] = info.IsDir()
+		return writeTarEntry(f.tw, p, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, w := range whiteouts {
+		f.deleted[w] = true
+	}
+
+	for _, o := range opaques {
+		f.opaque[o] = true
+	}
+
+	return nil
+}
+
+// hidden reports whether an upper layer hides rel from the lower layers.
+func (f *tarFlattener) hidden(rel string) bool {
+	for p := rel; ; p = filepath.Dir(p) {
+		if f.deleted[p] {
+			return true
+		}
+
+		if p != rel {
+			if f.opaque[p] {
+				return true
+			}
+
+			if isDir, ok := f.emitted[p]; ok && !isDir {
+				return true
+			}
+		}
+
+		if p == "." {
+			return false
+		}
+	}
+}
+
+// writeTarEntry writes the file at p (which info describes) to tw, calling it
+// rel in the archive.
+func writeTarEntry(tw *tar.Writer, p string, rel string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	in, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, err = io.Copy(tw, in)
+	return err
+}
+
+// isWhiteoutDevice reports whether info is an overlayfs style whiteout, i.e. a
+// 0:0 character device.
+func isWhiteoutDevice(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
@@ -0,0 +1,164 @@
+package atomfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// writeLayer makes a layer directory under dir with the given files; names
+// ending in / are directories.
+func writeLayer(t *testing.T, dir string, name string, files map[string]string) string {
+	root := path.Join(dir, name)
+	for p, content := range files {
+		full := path.Join(root, p)
+		if strings.HasSuffix(p, "/") {
+			if err := os.MkdirAll(full, 0755); err != nil {
+				t.Fatalf("couldn't make dir %s", err)
+			}
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(full), 0755); err != nil {
+			t.Fatalf("couldn't make dir %s", err)
+		}
+
+		if err := ioutil.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatalf("couldn't write file %s", err)
+		}
+	}
+
+	return root
+}
+
+func TestFlattenLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-export-tar-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	upper := writeLayer(t, dir, "upper", map[string]string{
+		"changed":             "upper",
+		".wh.deleted":         "",
+		"opaque/.wh..wh..opq": "",
+		"opaque/new":          "upper",
+		"replaced":            "now a file",
+	})
+
+	lower := writeLayer(t, dir, "lower", map[string]string{
+		"changed":      "lower",
+		"deleted":      "lower",
+		"kept":         "lower",
+		"opaque/old":   "lower",
+		"replaced/sub": "lower",
+	})
+
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	f := &tarFlattener{
+		tw:      tw,
+		emitted: map[string]bool{},
+		deleted: map[string]bool{},
+		opaque:  map[string]bool{},
+	}
+
+	for _, layer := range []string{upper, lower} {
+		if err := f.addLayer(layer); err != nil {
+			t.Fatalf("couldn't add layer %s", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("couldn't close tar %s", err)
+	}
+
+	found := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("couldn't read tar %s", err)
+		}
+
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("couldn't read tar %s", err)
+		}
+		found[hdr.Name] = string(content)
+	}
+
+	expected := map[string]string{
+		"changed":    "upper",
+		"kept":       "lower",
+		"opaque/":    "",
+		"opaque/new": "upper",
+		"replaced":   "now a file",
+	}
+
+	names := []string{}
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(found) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	for name, content := range expected {
+		if found[name] != content {
+			t.Fatalf("expected %s to be %q, got %v", name, content, names)
+		}
+	}
+}
+
+func TestExportTarMissingAtom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-export-tar-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	atom, err := atomfs.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("broken", []types.Atom{atom}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if err := atomfs.storage.Remove(atom.FileName()); err != nil {
+		t.Fatalf("couldn't remove atom %s", err)
+	}
+
+	out := bytes.Buffer{}
+	if err := atomfs.ExportTar("broken", &out); !errors.Is(err, ErrAtomMissing) {
+		t.Fatalf("bad error exporting a molecule with a missing atom: %v", err)
+	}
+
+	if err := atomfs.ExportTar("missing", &out); !errors.Is(err, types.ErrMoleculeNotFound) {
+		t.Fatalf("bad error exporting a missing molecule: %v", err)
+	}
+
+	if out.Len() != 0 {
+		t.Fatalf("failed exports wrote %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,37 @@
+package atomfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FormatFSCK renders FSCK results as text, one tab separated line per problem:
+//
+//	<atom hash>	<kind>	<error>
+//
+// followed by a summary line. The layout is stable, so that it can be grepped
+// and diffed.
+func FormatFSCK(results []FSCKResult) string {
+	if len(results) == 0 {
+		return "fsck ok.\n"
+	}
+
+	b := strings.Builder{}
+	for _, r := range results {
+		fmt.Fprintf(&b, "%s\t%s\t%s\n", r.AtomHash, r.Kind, r.Err)
+	}
+	fmt.Fprintf(&b, "fsck failed: %d problems.\n", len(results))
+
+	return b.String()
+}
+
+// FormatStats renders store stats as text, one "name: value" line per stat.
+// The layout is stable, so that it can be grepped and diffed.
+func FormatStats(s Stats) string {
+	b := strings.Builder{}
+	fmt.Fprintf(&b, "atoms: %d\n", s.AtomCount)
+	fmt.Fprintf(&b, "unused atoms: %d\n", s.UnusedAtomCount)
+	fmt.Fprintf(&b, "molecules: %d\n", s.MoleculeCount)
+	fmt.Fprintf(&b, "bytes on disk: %d\n", s.TotalBytesOnDisk)
+	return b.String()
+}
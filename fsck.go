@@ -0,0 +1,1041 @@
+package atomfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/anuvu/atomfs/db"
+	"github.com/anuvu/atomfs/storage"
+	"github.com/anuvu/atomfs/types"
+)
+
+var (
+	// ErrAtomMissing is returned by VerifyAtom when the atom's file
+	// doesn't exist. It is the same error as types.ErrAtomMissing.
+	ErrAtomMissing = types.ErrAtomMissing
+	// ErrAtomCorrupt is returned by VerifyAtom when the atom's contents
+	// don't match its hash. It is the same error as types.ErrAtomCorrupt.
+	ErrAtomCorrupt = types.ErrAtomCorrupt
+)
+
+// FSCKErrorKind describes what is wrong with an atom that failed an FSCK.
+type FSCKErrorKind int
+
+const (
+	// FSCKMissing means the atom is in the db but not on disk.
+	FSCKMissing FSCKErrorKind = iota
+	// FSCKHashMismatch means the atom's contents don't match its hash.
+	FSCKHashMismatch
+	// FSCKIOError means the atom couldn't be read for some other reason.
+	FSCKIOError
+	// FSCKSizeMismatch means the atom's file isn't the size it was when
+	// it was imported.
+	FSCKSizeMismatch
+)
+
+func (k FSCKErrorKind) String() string {
+	switch k {
+	case FSCKMissing:
+		return "missing"
+	case FSCKHashMismatch:
+		return "hash mismatch"
+	case FSCKIOError:
+		return "io error"
+	case FSCKSizeMismatch:
+		return "size mismatch"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(k))
+	}
+}
+
+// FSCKResult describes a single problem found by FSCK.
+type FSCKResult struct {
+	AtomHash string
+	Kind     FSCKErrorKind
+	Err      error
+	// DuplicateOf is set for hash mismatches when the atom's contents
+	// actually hash to another atom that is already (correctly) on disk.
+	// In that case, the file for AtomHash is a removable duplicate.
+	DuplicateOf string
+}
+
+func (r FSCKResult) String() string {
+	return r.Err.Error()
+}
+
+func formatFSCKResults(results []FSCKResult) []string {
+	errs := []string{}
+	for _, r := range results {
+		errs = append(errs, r.String())
+	}
+	return errs
+}
+
+// FSCK does a filesystem check on this atomfs instance, returning any errors.
+//
+// FSCK and its variants hold the store's lock shared while they run, so they
+// never overlap with a GC (or anything else that deletes atoms), in this
+// process or any other, and the atoms are read from a single db snapshot. So
+// a successful FSCK means that every atom in the store when it started was
+// intact.
+func (atomfs *Instance) FSCK() ([]string, error) {
+	return atomfs.FSCKContext(context.Background())
+}
+
+// FSCKContext is like FSCK, but stops early and returns ctx.Err() if ctx is
+// cancelled.
+func (atomfs *Instance) FSCKContext(ctx context.Context) ([]string, error) {
+	results, err := atomfs.fsck(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return formatFSCKResults(results), nil
+}
+
+// FSCKWithProgress is like FSCK, but calls progress (if non-nil) before each
+// atom is checked, with the number of atoms checked so far, the total number
+// of atoms, and the hash of the atom about to be checked.
+func (atomfs *Instance) FSCKWithProgress(progress func(done, total int, currentHash string)) ([]string, error) {
+	results, err := atomfs.fsck(context.Background(), progress)
+	if err != nil {
+		return nil, err
+	}
+	return formatFSCKResults(results), nil
+}
+
+// FSCKDetailed is like FSCK, but returns structured results so that callers
+// can tell what went wrong with each atom.
+func (atomfs *Instance) FSCKDetailed() ([]FSCKResult, error) {
+	return atomfs.fsck(context.Background(), nil)
+}
+
+func (atomfs *Instance) fsck(ctx context.Context, progress func(int, int, string)) ([]FSCKResult, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	atomfs.log().Info("starting fsck")
+	started := time.Now()
+	defer atomfs.observe(OpFSCK, started)
+
+	total := 0
+	if progress != nil {
+		var err error
+		total, err = atomfs.db.CountAtoms()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := []FSCKResult{}
+
+	i := 0
+	err = atomfs.db.ForEachAtom(func(atom types.Atom) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if progress != nil {
+			progress(i, total, atom.Hash)
+		}
+		i++
+
+		result := atomfs.checkAtom(ctx, atom)
+		atomfs.count(CounterFSCKAtoms, 1)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if result != nil {
+			atomfs.logFSCKResult(*result)
+			results = append(results, *result)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	atomfs.log().Info("finished fsck", "errors", len(results))
+	atomfs.recordFSCK(started, i, len(results))
+	return results, nil
+}
+
+// FSCKResume is like FSCKContext, but remembers the result for each atom it
+// checks, and reuses the remembered results for atoms whose files haven't
+// changed (by size and modification time) since they were checked. That way a
+// big store can be checked over several runs, e.g. by cancelling ctx when a
+// maintenance window closes, with each run picking up where the last one left
+// off. Use ResetFSCK to start over.
+func (atomfs *Instance) FSCKResume(ctx context.Context) ([]FSCKResult, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	started := time.Now()
+	defer atomfs.observe(OpFSCK, started)
+
+	// Checkpoints are written as we go, which can't be done while a
+	// query over the atoms is still open: outside of WAL mode, the
+	// writes would wait for it forever.
+	atoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FSCKResult{}
+	checked := 0
+	for _, atom := range atoms {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		result, err := atomfs.resumeCheckAtom(ctx, atom)
+		if err != nil {
+			return nil, err
+		}
+		checked++
+
+		if result != nil {
+			atomfs.logFSCKResult(*result)
+			results = append(results, *result)
+		}
+	}
+
+	atomfs.recordFSCK(started, checked, len(results))
+	return results, nil
+}
+
+// resumeCheckAtom is checkAtom, but using and updating the atom's checkpoint.
+func (atomfs *Instance) resumeCheckAtom(ctx context.Context, atom types.Atom) (*FSCKResult, error) {
+	// Chunked atoms don't have one file whose changes we could notice.
+	if atom.Chunked {
+		return atomfs.checkAtom(ctx, atom), nil
+	}
+
+	fi, err := atomfs.storage.Stat(atom.FileName())
+	if err != nil {
+		// This is cheap to find out, so there's no point remembering
+		// it.
+		return atomfs.checkAtom(ctx, atom), nil
+	}
+
+	cp, ok, err := atomfs.db.GetFSCKCheckpoint(atom.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// If the storage doesn't know when the file was last changed, we
+	// can't tell whether the checkpoint is still good.
+	if ok && !fi.ModTime.IsZero() && cp.Size == fi.Size && cp.ModTime.Equal(fi.ModTime) {
+		if cp.OK {
+			return nil, nil
+		}
+
+		return &FSCKResult{atom.Hash, FSCKErrorKind(cp.Kind), errors.New(cp.Err), ""}, nil
+	}
+
+	result := atomfs.checkAtom(ctx, atom)
+	if err := ctx.Err(); err != nil {
+		// The check was cut short, so its result means nothing.
+		return nil, err
+	}
+
+	cp = db.FSCKCheckpoint{AtomID: atom.ID, Size: fi.Size, ModTime: fi.ModTime, OK: result == nil}
+	if result != nil {
+		cp.Kind = int(result.Kind)
+		cp.Err = result.Err.Error()
+	}
+
+	if err := atomfs.db.SetFSCKCheckpoint(cp); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ResetFSCK forgets the results remembered by FSCKResume, so that the next
+// FSCKResume checks every atom again.
+func (atomfs *Instance) ResetFSCK() error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.db.ClearFSCKCheckpoints()
+}
+
+// FSCKQuick is a cheap version of FSCK that only checks that each atom's file
+// exists and is the size it was when it was imported, without reading any of
+// them. Atoms it reports are definitely bad, but atoms it doesn't report may
+// still be corrupt; run FSCK to be sure. Atoms whose size wasn't recorded
+// (because they were imported by an older atomfs) are only checked for
+// presence.
+func (atomfs *Instance) FSCKQuick() ([]FSCKResult, error) {
+	return atomfs.statAtoms(true)
+}
+
+// FSCKPresenceOnly is for stores whose filesystem can be trusted to keep
+// files intact (e.g. ZFS): it only checks that every atom's file exists and
+// that every molecule's atoms are in the db, without reading or even checking
+// the size of any atoms.
+func (atomfs *Instance) FSCKPresenceOnly() ([]string, error) {
+	results, err := atomfs.statAtoms(false)
+	if err != nil {
+		return nil, err
+	}
+
+	refErrs, err := atomfs.FSCKReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(formatFSCKResults(results), refErrs...), nil
+}
+
+// MissingAtoms returns the atoms in the db whose files (or, for chunked atoms,
+// any of whose chunks) aren't in the atom storage, e.g. so that just those can
+// be fetched again after part of a disk was lost. It lists the storage once
+// rather than looking up each atom, so it is even cheaper than
+// FSCKPresenceOnly.
+func (atomfs *Instance) MissingAtoms() ([]types.Atom, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return atomfs.missingAtoms()
+}
+
+func (atomfs *Instance) missingAtoms() ([]types.Atom, error) {
+	files, err := atomfs.storage.List()
+	if err != nil {
+		return nil, err
+	}
+
+	onDisk := make(map[string]bool, len(files))
+	for _, f := range files {
+		onDisk[f.Name] = true
+	}
+
+	chunkUsers, err := atomfs.db.GetChunkUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := map[int64][]string{}
+	for hash, ids := range chunkUsers {
+		for _, id := range ids {
+			chunks[id] = append(chunks[id], types.Chunk{Hash: hash}.FileName())
+		}
+	}
+
+	missing := []types.Atom{}
+	err = atomfs.db.ForEachAtom(func(atom types.Atom) error {
+		names := []string{atom.FileName()}
+		if atom.Chunked {
+			names = chunks[atom.ID]
+		}
+
+		for _, name := range names {
+			if !onDisk[name] {
+				missing = append(missing, atom)
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+// MoleculeHealth describes a molecule that BrokenMolecules found.
+type MoleculeHealth struct {
+	Molecule string
+	// MissingAtoms are the hashes of the molecule's atoms that are
+	// missing, as in MissingAtoms. If there are none, the molecule has no
+	// atoms at all.
+	MissingAtoms []string
+}
+
+// BrokenMolecules returns the molecules that can't be used as they are:
+// those with atoms that are missing, and those with no atoms at all. Like
+// MissingAtoms, it lists the storage once, so it is cheap enough to run
+// regularly.
+func (atomfs *Instance) BrokenMolecules() ([]MoleculeHealth, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	missing, err := atomfs.missingAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	isMissing := map[int64]bool{}
+	for _, atom := range missing {
+		isMissing[atom.ID] = true
+	}
+
+	mols, err := atomfs.db.GetMolecules()
+	if err != nil {
+		return nil, err
+	}
+
+	broken := []MoleculeHealth{}
+	for _, mol := range mols {
+		health := MoleculeHealth{Molecule: mol.Name, MissingAtoms: []string{}}
+		seen := map[int64]bool{}
+		for _, atom := range mol.Atoms {
+			if isMissing[atom.ID] && !seen[atom.ID] {
+				health.MissingAtoms = append(health.MissingAtoms, atom.Hash)
+			}
+			seen[atom.ID] = true
+		}
+
+		if len(mol.Atoms) == 0 || len(health.MissingAtoms) > 0 {
+			broken = append(broken, health)
+		}
+	}
+
+	return broken, nil
+}
+
+// statAtoms checks that each atom's file exists, and if checkSize is true,
+// that it is the size it was when it was imported.
+func (atomfs *Instance) statAtoms(checkSize bool) ([]FSCKResult, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	results := []FSCKResult{}
+
+	err = atomfs.db.ForEachAtom(func(atom types.Atom) error {
+		if atom.Chunked {
+			missing, err := atomfs.missingChunks(atom)
+			if err != nil {
+				return err
+			}
+
+			if len(missing) > 0 {
+				err := fmt.Errorf("%s is missing chunks %v", atom.Hash, missing)
+				results = append(results, FSCKResult{atom.Hash, FSCKMissing, err, ""})
+			}
+			return nil
+		}
+
+		fi, err := atomfs.storage.Stat(atom.FileName())
+		if err != nil {
+			kind := FSCKIOError
+			if errors.Is(err, os.ErrNotExist) {
+				kind = FSCKMissing
+			}
+			results = append(results, FSCKResult{atom.Hash, kind, err, ""})
+			return nil
+		}
+
+		if checkSize && atom.SizeKnown && fi.Size != atom.Size {
+			err := fmt.Errorf("%s is %d bytes, expected %d", atom.Hash, fi.Size, atom.Size)
+			results = append(results, FSCKResult{atom.Hash, FSCKSizeMismatch, err, ""})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range results {
+		atomfs.logFSCKResult(r)
+	}
+
+	return results, nil
+}
+
+// FSCKParallel is like FSCK, but checks atoms using a pool of worker
+// goroutines. The order of the returned errors is not defined. A workers value
+// of 0 or 1 checks atoms sequentially, exactly like FSCK.
+func (atomfs *Instance) FSCKParallel(workers int) ([]string, error) {
+	if workers <= 1 {
+		return atomfs.FSCK()
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	started := time.Now()
+	defer atomfs.observe(OpFSCK, started)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := []FSCKResult{}
+	work := make(chan types.Atom)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atom := range work {
+				result := atomfs.checkAtom(context.Background(), atom)
+				atomfs.count(CounterFSCKAtoms, 1)
+				if result == nil {
+					continue
+				}
+
+				atomfs.logFSCKResult(*result)
+				mu.Lock()
+				results = append(results, *result)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	checked := 0
+	err = atomfs.db.ForEachAtom(func(atom types.Atom) error {
+		work <- atom
+		checked++
+		return nil
+	})
+	close(work)
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	atomfs.recordFSCK(started, checked, len(results))
+	return formatFSCKResults(results), nil
+}
+
+// checkAtom verifies that the atom exists on disk and that its (uncompressed)
+// contents match its hash, returning nil if everything is ok.
+func (atomfs *Instance) checkAtom(ctx context.Context, atom types.Atom) *FSCKResult {
+	f, err := atomfs.openAtom(atom)
+	if err != nil {
+		kind := FSCKIOError
+		if errors.Is(err, os.ErrNotExist) {
+			kind = FSCKMissing
+		}
+		return &FSCKResult{atom.Hash, kind, err, ""}
+	}
+	defer f.Close()
+
+	h, err := atom.Algorithm.New()
+	if err != nil {
+		return &FSCKResult{atom.Hash, FSCKIOError, err, ""}
+	}
+
+	if _, err := io.Copy(h, &ctxReader{ctx, f}); err != nil {
+		// Chunked atoms' chunks are opened and checked as they're
+		// read.
+		kind := FSCKIOError
+		if errors.Is(err, os.ErrNotExist) {
+			kind = FSCKMissing
+		} else if errors.Is(err, ErrAtomCorrupt) {
+			kind = FSCKHashMismatch
+		}
+		return &FSCKResult{atom.Hash, kind, err, ""}
+	}
+
+	actual := fmt.Sprintf("%x", h.Sum(nil))
+	if actual != atom.Hash {
+		// If the content we found is present under its correct name,
+		// this file is just a bad copy of it.
+		other := types.Atom{Hash: actual, Algorithm: atom.Algorithm}
+		if _, err := atomfs.storage.Stat(other.FileName()); err == nil {
+			err := fmt.Errorf("%s does not match its hash; it is a duplicate of %s", atom.Hash, actual)
+			return &FSCKResult{atom.Hash, FSCKHashMismatch, err, actual}
+		}
+
+		err := fmt.Errorf("%s does not match its hash", atom.Hash)
+		return &FSCKResult{atom.Hash, FSCKHashMismatch, err, ""}
+	}
+
+	return nil
+}
+
+// logFSCKResult logs and counts a problem found by FSCK.
+func (atomfs *Instance) logFSCKResult(r FSCKResult) {
+	atomfs.count(CounterFSCKErrors, 1)
+	atomfs.log().Warn("fsck error", "hash", r.AtomHash, "kind", r.Kind.String(), "err", r.Err)
+}
+
+// recordFSCK remembers a completed FSCK run for LastFSCK. A store that can't be
+// written to can still be checked, so failing to record the run isn't an
+// error, just a warning.
+func (atomfs *Instance) recordFSCK(started time.Time, atoms int, errs int) {
+	if atomfs.config.ReadOnly {
+		return
+	}
+
+	run := types.FSCKRun{Started: started.UTC(), Finished: time.Now().UTC(), Atoms: atoms, Errors: errs}
+	if err := atomfs.db.AddFSCKRun(run); err != nil {
+		atomfs.log().Warn("couldn't record fsck run", "err", err)
+	}
+}
+
+// LastFSCK returns the most recent run of FSCK (or FSCKContext,
+// FSCKWithProgress, FSCKDetailed, FSCKParallel, FSCKResume or FSCKFix) that
+// wasn't cut short, whether or not it found any problems. Runs by read only
+// instances aren't recorded. If there hasn't been one, the result is the zero
+// FSCKRun, so e.g. time.Since(run.Finished) is huge.
+func (atomfs *Instance) LastFSCK() (types.FSCKRun, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.FSCKRun{}, err
+	}
+	defer release()
+
+	run, _, err := atomfs.db.GetLastFSCKRun(false)
+	return run, err
+}
+
+// LastCleanFSCK is like LastFSCK, but returns the most recent run that found no
+// problems, e.g. to alert if the store hasn't been checked clean in a while.
+func (atomfs *Instance) LastCleanFSCK() (types.FSCKRun, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.FSCKRun{}, err
+	}
+	defer release()
+
+	run, _, err := atomfs.db.GetLastFSCKRun(true)
+	return run, err
+}
+
+// FSCKReferences checks that every atom referenced by a molecule exists in the
+// db (and vice versa), returning a description of each reference that
+// doesn't. Unlike FSCK, it doesn't read any atoms.
+func (atomfs *Instance) FSCKReferences() ([]string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	refs, err := atomfs.db.GetDanglingReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	errs := []string{}
+	for _, ref := range refs {
+		if ref.Molecule == "" {
+			errs = append(errs, fmt.Sprintf("atom %d is referenced by missing molecule %d", ref.AtomID, ref.MoleculeID))
+		} else {
+			errs = append(errs, fmt.Sprintf("molecule %s references missing atom %d", ref.Molecule, ref.AtomID))
+		}
+	}
+
+	return errs, nil
+}
+
+// VerifyAtom checks the integrity of a single sha256 atom, returning an error
+// wrapping ErrAtomMissing or ErrAtomCorrupt if it is absent or its contents
+// don't match its hash.
+func (atomfs *Instance) VerifyAtom(hash string) error {
+	return atomfs.VerifyAtomDigest(types.Digest{Algorithm: types.SHA256, Hash: hash})
+}
+
+// VerifyAtomDigest is like VerifyAtom, but for an atom of any digest
+// algorithm.
+func (atomfs *Instance) VerifyAtomDigest(d types.Digest) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	hash := d.Hash
+
+	// Use the db's idea of the atom if it has one, since that knows how
+	// the atom is compressed.
+	atom, ok, err := atomfs.db.GetAtomByHash(hash)
+	if err != nil {
+		return err
+	}
+
+	if !ok || atom.Digest().String() != d.String() {
+		atom = types.Atom{Name: hash, Hash: hash, Algorithm: d.Algorithm}
+	}
+
+	return fsckResultError(atomfs.checkAtom(context.Background(), atom))
+}
+
+// fsckResultError returns an error wrapping ErrAtomMissing or ErrAtomCorrupt
+// for a problem found by checkAtom, or nil if there wasn't one.
+func fsckResultError(result *FSCKResult) error {
+	if result == nil {
+		return nil
+	}
+
+	switch result.Kind {
+	case FSCKMissing:
+		return fmt.Errorf("%w: %s", ErrAtomMissing, result.AtomHash)
+	case FSCKHashMismatch:
+		return fmt.Errorf("%w: %s", ErrAtomCorrupt, result.AtomHash)
+	default:
+		return result.Err
+	}
+}
+
+// VerifyMolecule checks the integrity of just the atoms that the molecule uses,
+// returning a result for each one that is missing or corrupt. It's meant as a
+// cheap check before mounting the molecule.
+func (atomfs *Instance) VerifyMolecule(name string) ([]FSCKResult, error) {
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mol, err := atomfs.db.GetMolecule(name)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []FSCKResult{}
+	seen := map[int64]bool{}
+	for _, atom := range mol.Atoms {
+		if seen[atom.ID] {
+			continue
+		}
+		seen[atom.ID] = true
+
+		if result := atomfs.checkAtom(context.Background(), atom); result != nil {
+			results = append(results, *result)
+		}
+	}
+
+	return results, nil
+}
+
+// FSCKFix is like FSCK, but also prunes any atoms that are missing or don't
+// match their hash. Molecules that reference a bad atom are deleted, since
+// they can no longer be mounted, and soft deleted ones are purged. Molecules
+// that are mounted (and so their bad atoms) are left alone and reported along
+// with the errors. If dryRun is true, nothing is deleted, but the returned list
+// of repairs describes what would have been done.
+func (atomfs *Instance) FSCKFix(dryRun bool) ([]string, []string, error) {
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	started := time.Now()
+	atoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repaired := []string{}
+	errs := []string{}
+
+	for _, atom := range atoms {
+		result := atomfs.checkAtom(context.Background(), atom)
+		if result == nil {
+			continue
+		}
+		atomfs.logFSCKResult(*result)
+		errs = append(errs, result.String())
+
+		fixed, skipped, err := atomfs.fixBadAtom(atom, dryRun)
+		if err != nil {
+			return nil, nil, err
+		}
+		repaired = append(repaired, fixed...)
+		errs = append(errs, skipped...)
+	}
+
+	atomfs.recordFSCK(started, len(atoms), len(errs))
+	return repaired, errs, nil
+}
+
+// fixBadAtom deletes the molecules that use the bad atom, and then the atom
+// itself, all in one transaction, returning a description of each repair.
+// Mounted molecules are left alone, since their mounts still reference them,
+// and are returned in skipped; the atom is kept if any of them use it.
+func (atomfs *Instance) fixBadAtom(atom types.Atom, dryRun bool) ([]string, []string, error) {
+	repaired := []string{}
+	skipped := []string{}
+	removeFile := false
+
+	err := atomfs.inTx(func(tx *Instance) error {
+		repaired = []string{}
+		skipped = []string{}
+
+		mols, err := tx.db.GetMoleculesUsingAtom(atom.ID)
+		if err != nil {
+			return err
+		}
+
+		// Soft deleted molecules still reference their atoms, so they
+		// have to go too, grace period or not.
+		deleted, err := tx.db.GetDeletedMoleculesUsingAtom(atom.ID)
+		if err != nil {
+			return err
+		}
+
+		for i, mol := range append(mols, deleted...) {
+			live := i < len(mols)
+
+			mounted, err := tx.db.IsMoleculeMounted(mol.ID)
+			if err != nil {
+				return err
+			}
+
+			if mounted {
+				skipped = append(skipped, fmt.Sprintf("can't delete molecule %s (uses bad atom %s): it is mounted", mol.Name, atom.Hash))
+				continue
+			}
+
+			if live {
+				repaired = append(repaired, fmt.Sprintf("deleted molecule %s (uses bad atom %s)", mol.Name, atom.Hash))
+			} else {
+				repaired = append(repaired, fmt.Sprintf("purged deleted molecule %s (uses bad atom %s)", mol.Name, atom.Hash))
+			}
+			if dryRun {
+				continue
+			}
+
+			if err := tx.db.DeleteThing(mol.ID, "molecule"); err != nil {
+				return err
+			}
+
+			if live {
+				tx.emit(MoleculeDeleted, mol.Name, "")
+			}
+		}
+
+		if len(skipped) > 0 {
+			return nil
+		}
+
+		repaired = append(repaired, fmt.Sprintf("deleted atom %s", atom.Hash))
+		if dryRun {
+			return nil
+		}
+
+		removeFile = true
+		return tx.db.DeleteThing(atom.ID, "atom")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The file is only removed once the atom is gone from the db, so that a
+	// failed transaction doesn't leave an atom without its file.
+	if removeFile {
+		err = atomfs.storage.Remove(atom.FileName())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+	}
+
+	return repaired, skipped, nil
+}
+
+// RepairAtomNames finds atoms whose content doesn't match their hash, but is
+// otherwise intact (e.g. because the file was renamed), and renames them after
+// their actual hash, fixing up the db to match. Atoms whose actual hash is
+// already taken by another atom or file are left alone and reported as
+// collisions, as are mounted atoms. It returns a description of each repair
+// (or, if dryRun is true, each repair that would have been made).
+func (atomfs *Instance) RepairAtomNames(dryRun bool) ([]string, error) {
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	atoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []string{}
+	for _, atom := range atoms {
+		// Chunked atoms have no file to rename, and their chunks are
+		// checked against their own hashes whenever they're read.
+		if atom.Chunked {
+			continue
+		}
+
+		actual, err := atomfs.hashAtom(atom, atom.Algorithm)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return repairs, err
+		}
+
+		if actual == atom.Hash {
+			continue
+		}
+
+		if mounted[atom.Hash] {
+			repairs = append(repairs, fmt.Sprintf("can't rename atom %s to %s: it is mounted", atom.Hash, actual))
+			continue
+		}
+
+		fixed := atom
+		fixed.Hash = actual
+		if atom.Name == atom.Hash {
+			fixed.Name = actual
+		}
+
+		collision, err := atomfs.atomNameTaken(fixed)
+		if err != nil {
+			return repairs, err
+		}
+
+		if collision {
+			repairs = append(repairs, fmt.Sprintf("can't rename atom %s to %s: %s already exists", atom.Hash, actual, actual))
+			continue
+		}
+
+		repairs = append(repairs, fmt.Sprintf("renamed atom %s to %s", atom.Hash, actual))
+		if dryRun {
+			continue
+		}
+
+		if err := atomfs.renameAtomFile(atom.FileName(), fixed.FileName()); err != nil {
+			return repairs, err
+		}
+
+		if err := atomfs.db.SetAtomHash(atom.ID, fixed.Hash, fixed.Name); err != nil {
+			// Put the file back, so it still matches the db.
+			atomfs.renameAtomFile(fixed.FileName(), atom.FileName())
+			return repairs, err
+		}
+	}
+
+	return repairs, nil
+}
+
+// hashAtom returns the hash of the atom's (uncompressed) content, computed with
+// alg.
+func (atomfs *Instance) hashAtom(atom types.Atom, alg types.DigestAlgorithm) (string, error) {
+	f, err := atomfs.openAtom(atom)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return alg.HashReader(f)
+}
+
+// atomNameTaken reports whether there is already an atom in the db or a file
+// in the storage with atom's hash.
+func (atomfs *Instance) atomNameTaken(atom types.Atom) (bool, error) {
+	_, ok, err := atomfs.db.GetAtomByHash(atom.Hash)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	_, err = atomfs.storage.Stat(atom.FileName())
+	if err == nil {
+		return true, nil
+	} else if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// renameAtomFile moves the atom file called from to to. Local storage can
+// just rename it; anything else has to copy it.
+func (atomfs *Instance) renameAtomFile(from string, to string) error {
+	if local, ok := atomfs.storage.(*storage.Local); ok {
+		dest := local.CanonicalPath(to)
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return err
+		}
+
+		return os.Rename(local.Path(from), dest)
+	}
+
+	in, err := atomfs.storage.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	w, err := atomfs.storage.Create()
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, in); err != nil {
+		w.Abort()
+		return err
+	}
+
+	if err := w.Commit(to); err != nil {
+		return err
+	}
+
+	return atomfs.storage.Remove(from)
+}
+
+// ctxReader is an io.Reader that starts failing once its context is
+// cancelled, so that hashing a large atom doesn't hold up a cancellation.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,169 @@
+package atomfs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestFSCKResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-fsck-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The default journal mode, where a write can't commit while a query
+	// is still open.
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	atoms := []types.Atom{}
+	for _, content := range []string{"foo", "bar", "baz"} {
+		atom, err := atomfs.ImportAtom(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("couldn't import atom %s", err)
+		}
+		atoms = append(atoms, atom)
+	}
+
+	results, err := atomfs.FSCKResume(context.Background())
+	if err != nil {
+		t.Fatalf("couldn't fsck %s", err)
+	}
+
+	if len(results) != 0 {
+		t.Fatalf("fsck of a clean store found %v", results)
+	}
+
+	for _, atom := range atoms {
+		cp, ok, err := atomfs.db.GetFSCKCheckpoint(atom.ID)
+		if err != nil {
+			t.Fatalf("couldn't get checkpoint %s", err)
+		}
+
+		if !ok || !cp.OK {
+			t.Fatalf("atom %s wasn't checkpointed as ok: %v", atom.Hash, cp)
+		}
+	}
+
+	// A second run reuses the checkpoints, and still finds nothing.
+	results, err = atomfs.FSCKResume(context.Background())
+	if err != nil {
+		t.Fatalf("couldn't fsck %s", err)
+	}
+
+	if len(results) != 0 {
+		t.Fatalf("resumed fsck of a clean store found %v", results)
+	}
+}
+
+func TestFSCKFix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-fsck-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	deleted := []string{}
+	atomfs.SetEventHandler(func(ev Event) {
+		if ev.Op == MoleculeDeleted {
+			deleted = append(deleted, ev.Molecule)
+		}
+	})
+
+	bad := []types.Atom{}
+	for _, content := range []string{"foo", "bar"} {
+		atom, err := atomfs.ImportAtom(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("couldn't import atom %s", err)
+		}
+		bad = append(bad, atom)
+	}
+
+	good, err := atomfs.ImportAtom(strings.NewReader("baz"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("broken", []types.Atom{bad[0], good}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	mounted, err := atomfs.CreateMolecule("mounted", []types.Atom{bad[1]})
+	if err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("fine", []types.Atom{good}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	// Recording the mount is enough; nothing needs to be really mounted.
+	if err := atomfs.db.AddMount("/somewhere", mounted.ID); err != nil {
+		t.Fatalf("couldn't add mount %s", err)
+	}
+
+	for _, atom := range bad {
+		w, err := atomfs.storage.Create()
+		if err != nil {
+			t.Fatalf("couldn't create object %s", err)
+		}
+
+		if _, err := w.Write([]byte("corrupt")); err != nil {
+			t.Fatalf("couldn't write object %s", err)
+		}
+
+		if err := w.Commit(atom.FileName()); err != nil {
+			t.Fatalf("couldn't commit object %s", err)
+		}
+	}
+
+	repaired, errs, err := atomfs.FSCKFix(false)
+	if err != nil {
+		t.Fatalf("couldn't fsck %s", err)
+	}
+
+	// One error for each bad atom, and one for the mounted molecule.
+	if len(errs) != 3 {
+		t.Fatalf("expected three errors, got %v", errs)
+	}
+
+	if len(repaired) != 2 {
+		t.Fatalf("expected two repairs, got %v", repaired)
+	}
+
+	if len(deleted) != 1 || deleted[0] != "broken" {
+		t.Fatalf("bad delete events %v", deleted)
+	}
+
+	if _, err := atomfs.GetMolecule("broken"); !errors.Is(err, types.ErrMoleculeNotFound) {
+		t.Fatalf("molecule using a bad atom wasn't deleted: %v", err)
+	}
+
+	for _, name := range []string{"mounted", "fine"} {
+		if _, err := atomfs.GetMolecule(name); err != nil {
+			t.Fatalf("couldn't get molecule %s: %s", name, err)
+		}
+	}
+
+	if ok, err := atomfs.HasAtom(bad[0].Hash); err != nil || ok {
+		t.Fatalf("bad atom wasn't deleted: %v %v", ok, err)
+	}
+
+	if ok, err := atomfs.HasAtom(bad[1].Hash); err != nil || !ok {
+		t.Fatalf("bad atom of a mounted molecule was deleted: %v %v", ok, err)
+	}
+}
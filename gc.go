@@ -0,0 +1,658 @@
+package atomfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anuvu/atomfs/mount"
+	"github.com/anuvu/atomfs/storage"
+	"github.com/anuvu/atomfs/types"
+)
+
+// GCReport describes what a GC removed (or, for a dry run, would have
+// removed).
+type GCReport struct {
+	// PrunedAtoms are the atoms that were unused by any molecule, and
+	// were deleted from the db.
+	PrunedAtoms []types.Atom
+	// OrphanedFiles are the files in the atoms directory that weren't
+	// in the db, and were deleted from disk.
+	OrphanedFiles []string
+	// TempFiles are the temporary files left in the atoms directory by
+	// interrupted imports, which were deleted.
+	TempFiles []string
+	// SkippedAtoms are the atoms that were unused by any molecule, but
+	// were left alone because they are currently mounted.
+	SkippedAtoms []types.Atom
+	// PinnedAtoms are the atoms that were unused by any molecule, but
+	// were left alone because they are pinned.
+	PinnedAtoms []types.Atom
+	// EmptyMolecules are the molecules with no atoms that were deleted.
+	// It is only filled in if GCOptions.EmptyMolecules is set.
+	EmptyMolecules []types.Molecule
+	// PurgedMolecules are the soft deleted molecules whose grace period
+	// was over, which were permanently deleted.
+	PurgedMolecules []types.Molecule
+}
+
+// GCOptions tunes what a GC collects.
+type GCOptions struct {
+	// DryRun reports what would be collected, without deleting anything.
+	DryRun bool
+	// EmptyMolecules also deletes molecules that have no atoms (unless
+	// they're mounted or pinned).
+	EmptyMolecules bool
+}
+
+// GC does a garbage collection of atomfs, deleting any unused atoms, and any
+// files in the atom directory that aren't in the database.
+func (atomfs *Instance) GC(dryRun bool) error {
+	return atomfs.GCContext(context.Background(), dryRun)
+}
+
+// GCContext is like GC, but stops early and returns ctx.Err() if ctx is
+// cancelled.
+func (atomfs *Instance) GCContext(ctx context.Context, dryRun bool) error {
+	_, err := atomfs.gc(ctx, GCOptions{DryRun: dryRun})
+	return err
+}
+
+// GCReport is like GC, but returns a report of what was collected.
+func (atomfs *Instance) GCReport(dryRun bool) (GCReport, error) {
+	return atomfs.gc(context.Background(), GCOptions{DryRun: dryRun})
+}
+
+// GCWithOptions is like GCReport, but with options controlling what is
+// collected.
+func (atomfs *Instance) GCWithOptions(opts GCOptions) (GCReport, error) {
+	return atomfs.gc(context.Background(), opts)
+}
+
+func (atomfs *Instance) gc(ctx context.Context, opts GCOptions) (GCReport, error) {
+	dryRun := opts.DryRun
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return GCReport{}, err
+		}
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return GCReport{}, err
+	}
+	defer unlock()
+
+	atomfs.log().Info("starting gc", "dryRun", dryRun)
+	defer atomfs.observe(OpGC, time.Now())
+
+	report := GCReport{
+		PrunedAtoms:    []types.Atom{},
+		OrphanedFiles:  []string{},
+		TempFiles:      []string{},
+		SkippedAtoms:   []types.Atom{},
+		PinnedAtoms:    []types.Atom{},
+		EmptyMolecules: []types.Molecule{},
+	}
+
+	// Soft deleted molecules whose grace period is over go first, so that
+	// their atoms can be pruned below.
+	purged, err := atomfs.purgeDeleted(dryRun)
+	if err != nil {
+		return report, err
+	}
+	report.PurgedMolecules = purged
+
+	if opts.EmptyMolecules {
+		empty, err := atomfs.db.GetEmptyMolecules()
+		if err != nil {
+			return report, err
+		}
+
+		for _, mol := range empty {
+			if !dryRun {
+				if err := atomfs.db.DeleteThing(mol.ID, "molecule"); err != nil {
+					return report, err
+				}
+				atomfs.emit(MoleculeDeleted, mol.Name, "")
+			}
+
+			atomfs.log().Debug("deleted empty molecule", "name", mol.Name, "dryRun", dryRun)
+			report.EmptyMolecules = append(report.EmptyMolecules, mol)
+		}
+	}
+
+	// Atoms can be mounted without being referenced by a molecule, e.g.
+	// if a mounted molecule was deleted by an older atomfs, or the mount
+	// was never recorded. Pulling their files out from under the mount
+	// would be bad, so leave them alone.
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return report, err
+	}
+
+	// First, let's prune unused atoms from the DB.
+	unusedAtoms, err := atomfs.db.GetUnusedAtoms()
+	if err != nil {
+		return report, err
+	}
+
+	for _, atom := range unusedAtoms {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		if mounted[atom.Hash] {
+			report.SkippedAtoms = append(report.SkippedAtoms, atom)
+			continue
+		}
+
+		if atom.Pinned {
+			report.PinnedAtoms = append(report.PinnedAtoms, atom)
+			continue
+		}
+
+		if !dryRun {
+			if err := atomfs.db.DeleteThing(atom.ID, "atom"); err != nil {
+				return report, err
+			}
+		}
+
+		atomfs.log().Debug("pruned atom", "hash", atom.Hash, "dryRun", dryRun)
+		report.PrunedAtoms = append(report.PrunedAtoms, atom)
+	}
+
+	// Now, delete everything that's on disk that isn't in our DB.
+	onDiskAtoms, err := atomfs.storage.List()
+	if err != nil {
+		return report, err
+	}
+
+	inDBAtoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		return report, err
+	}
+
+	// In a dry run, the pruned atoms are still in the db, but their files
+	// would have been orphaned by a real run.
+	var pruned []types.Atom
+	if dryRun {
+		pruned = report.PrunedAtoms
+	}
+
+	// Temp files from interrupted imports aren't atoms at all, so they're
+	// cleaned up by name rather than being treated as orphans. Since we
+	// hold the store lock exclusively, no import can be in progress.
+	names := []string{}
+	for _, onDiskAtom := range onDiskAtoms {
+		if !isTempAtomFile(onDiskAtom.Name) {
+			names = append(names, onDiskAtom.Name)
+			continue
+		}
+
+		if !dryRun {
+			err := atomfs.storage.Remove(onDiskAtom.Name)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return report, err
+			}
+		}
+
+		report.TempFiles = append(report.TempFiles, onDiskAtom.Name)
+	}
+
+	// Chunks are kept as long as an atom that isn't being pruned uses
+	// them. Chunked atoms' own files are only reassembled copies, so they
+	// are treated as orphans, and kept only while they're mounted.
+	chunkUsers, err := atomfs.db.GetChunkUsers()
+	if err != nil {
+		return report, err
+	}
+
+	live := liveChunkFiles(chunkUsers, pruned)
+	unchunked := []string{}
+	for _, name := range names {
+		if !live[name] {
+			unchunked = append(unchunked, name)
+		}
+	}
+
+	wholeAtoms := []types.Atom{}
+	for _, atom := range inDBAtoms {
+		if !atom.Chunked {
+			wholeAtoms = append(wholeAtoms, atom)
+		}
+	}
+
+	for _, name := range orphanedAtomFiles(unchunked, wholeAtoms, pruned) {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		if mounted[path.Base(name)] {
+			continue
+		}
+
+		if !dryRun {
+			err := atomfs.storage.Remove(name)
+			if err != nil {
+				return report, err
+			}
+		}
+
+		atomfs.log().Debug("removed orphaned file", "name", name, "dryRun", dryRun)
+		report.OrphanedFiles = append(report.OrphanedFiles, name)
+	}
+
+	atomfs.log().Info("finished gc",
+		"dryRun", dryRun,
+		"prunedAtoms", len(report.PrunedAtoms),
+		"orphanedFiles", len(report.OrphanedFiles),
+		"tempFiles", len(report.TempFiles),
+		"skippedAtoms", len(report.SkippedAtoms),
+		"emptyMolecules", len(report.EmptyMolecules))
+
+	if !dryRun {
+		atomfs.count(CounterGCPrunedAtoms, len(report.PrunedAtoms))
+		atomfs.count(CounterGCFiles, len(report.OrphanedFiles)+len(report.TempFiles))
+	}
+
+	return report, nil
+}
+
+// GCToSize prunes atoms that aren't used by any molecule (and aren't mounted or
+// pinned), least recently used first, until the atoms on disk take up no more
+// than maxBytes, returning the atoms it pruned. Atoms are used when they're
+// imported (even if they already existed), opened or mounted, or when a
+// molecule using them is exported. Referenced atoms are never pruned, so the
+// store may still be bigger than maxBytes afterwards. Atom files that are hard links to one another count once, and
+// only stop counting once their last link is gone, as in UnusedAtomsReport.
+// A pruned chunked atom frees the chunks that no remaining atom uses.
+func (atomfs *Instance) GCToSize(maxBytes int64) ([]types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := atomfs.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	files, err := atomfs.storage.List()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files that are hard links to one another only take up space once,
+	// and it isn't freed until the last link (which may not even be in
+	// this store) is gone.
+	infos := map[string]storage.FileInfo{}
+	links := map[uint64]uint64{}
+	for _, f := range files {
+		infos[f.Name] = f
+		links[f.Inode] = f.Links
+	}
+	total := storage.UniqueBytes(files)
+
+	// remove removes the file called name, and stops counting it. It may
+	// be called more than once for the same chunk.
+	remove := func(name string) error {
+		err := atomfs.storage.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		if fi, ok := infos[name]; ok {
+			if fi.Inode == 0 {
+				total -= fi.Size
+			} else if links[fi.Inode]--; links[fi.Inode] == 0 {
+				total -= fi.Size
+			}
+			delete(infos, name)
+		}
+		return nil
+	}
+
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := atomfs.db.GetUnusedAtomsLRU()
+	if err != nil {
+		return nil, err
+	}
+
+	chunkUsers, err := atomfs.db.GetChunkUsers()
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []types.Atom{}
+	for _, atom := range candidates {
+		if total <= maxBytes {
+			break
+		}
+
+		if mounted[atom.Hash] || atom.Pinned {
+			continue
+		}
+
+		// A chunked atom's own file is only a reassembled copy (if it is
+		// there at all); its space is in the chunks, which may be shared.
+		chunks := []types.Chunk{}
+		if atom.Chunked {
+			chunks, err = atomfs.db.GetAtomChunks(atom.ID)
+			if err != nil {
+				return pruned, err
+			}
+		}
+
+		if err := atomfs.db.DeleteThing(atom.ID, "atom"); err != nil {
+			return pruned, err
+		}
+
+		if err := remove(atom.FileName()); err != nil {
+			return pruned, err
+		}
+
+		atomfs.log().Debug("pruned atom", "hash", atom.Hash)
+		pruned = append(pruned, atom)
+
+		live := liveChunkFiles(chunkUsers, pruned)
+		for _, chunk := range chunks {
+			if live[chunk.FileName()] {
+				continue
+			}
+
+			if err := remove(chunk.FileName()); err != nil {
+				return pruned, err
+			}
+		}
+		atomfs.count(CounterGCPrunedAtoms, 1)
+	}
+
+	return pruned, nil
+}
+
+// UnusedAtomsReport returns the atoms that a GC would prune, i.e. the ones that
+// aren't used by any molecule and aren't mounted or pinned, along with how many
+// bytes of disk pruning them would free. Files with hard links elsewhere (e.g.
+// in another store) don't count, since their space isn't freed until the last
+// link is gone, and files that are links to one another only count once.
+// Chunked atoms count as their recorded size.
+func (atomfs *Instance) UnusedAtomsReport() ([]types.Atom, int64, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
+
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	unused, err := atomfs.db.GetUnusedAtoms()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	atoms := []types.Atom{}
+	files := []storage.FileInfo{}
+	total := int64(0)
+	for _, atom := range unused {
+		if mounted[atom.Hash] || atom.Pinned {
+			continue
+		}
+
+		atoms = append(atoms, atom)
+
+		// Chunked atoms' chunks may be shared, so just count them as
+		// their recorded size.
+		if atom.Chunked {
+			size, err := atomfs.atomBytes(atom)
+			if err != nil {
+				return nil, 0, err
+			}
+			total += size
+			continue
+		}
+
+		fi, err := atomfs.storage.Stat(atom.FileName())
+		if err == nil {
+			files = append(files, fi)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, 0, err
+		}
+	}
+
+	return atoms, total + storage.ReclaimableBytes(files), nil
+}
+
+// atomBytes returns the atom's recorded size, or the size of its file if it
+// doesn't have one. Atoms whose files are gone take up no space.
+func (atomfs *Instance) atomBytes(atom types.Atom) (int64, error) {
+	if atom.SizeKnown {
+		return atom.Size, nil
+	}
+
+	fi, err := atomfs.storage.Stat(atom.FileName())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return fi.Size, nil
+}
+
+// ReshardAtoms moves the atoms' files to match Config.ShardLevels, e.g. after
+// turning sharding on for an existing store. Atoms are found wherever they
+// are either way, so this only matters for performance.
+func (atomfs *Instance) ReshardAtoms() error {
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	local, ok := atomfs.storage.(*storage.Local)
+	if !ok {
+		return errors.New("only local storage can be resharded")
+	}
+
+	unlock, err := atomfs.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return local.Reshard()
+}
+
+// Defrag is like ReshardAtoms, but also removes shard directories that are
+// left empty (e.g. after lots of atoms have been deleted), and returns the
+// names of the atom files it moved. If dryRun is true, nothing is changed,
+// but the files that would have been moved are still returned. Nothing in the
+// db changes, since where atoms' files are is derived from their hashes, and
+// it is safe to interrupt: each file is always either where it was or where
+// it belongs.
+func (atomfs *Instance) Defrag(dryRun bool) ([]string, error) {
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	local, ok := atomfs.storage.(*storage.Local)
+	if !ok {
+		return nil, errors.New("only local storage can be defragmented")
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return local.Defrag(dryRun)
+}
+
+// isTempAtomFile reports whether name is a temp file written during an import.
+// "create-atom-" is the prefix that older versions of atomfs used.
+func isTempAtomFile(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, storage.TempPrefix) || strings.HasPrefix(base, "create-atom-")
+}
+
+// mountedAtoms returns the set of hashes of the atoms that are currently
+// mounted, according to /proc/self/mountinfo.
+func (atomfs *Instance) mountedAtoms() (map[string]bool, error) {
+	mounts, err := mount.ParseMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	mounted := map[string]bool{}
+	for _, m := range mounts {
+		if path.Dir(m.Target) == atomfs.config.MountedAtomsPath() {
+			mounted[path.Base(m.Target)] = true
+		}
+	}
+
+	return mounted, nil
+}
+
+// GCMolecule is a targeted GC for after a molecule has been deleted: given the
+// hashes of the atoms it used, it prunes just the ones that aren't used by
+// any other molecule (or mounted), returning them. Nothing else in the store
+// is looked at, so this is much cheaper than a full GC; hashes that aren't
+// atoms (e.g. ones that were already pruned) are ignored. Chunks of pruned
+// chunked atoms are left for the next full GC. If dryRun is true, the atoms
+// that would be pruned are returned, but nothing is deleted.
+func (atomfs *Instance) GCMolecule(atomHashes []string, dryRun bool) ([]types.Atom, error) {
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return nil, err
+		}
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	atoms := []types.Atom{}
+	for _, hash := range atomHashes {
+		atom, ok, err := atomfs.db.GetAtomByHash(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			atoms = append(atoms, atom)
+		}
+	}
+
+	pruned, err := atomfs.pruneAtomsIfUnused(atoms, dryRun)
+	if err != nil {
+		return pruned, err
+	}
+
+	if !dryRun {
+		atomfs.count(CounterGCPrunedAtoms, len(pruned))
+	}
+
+	return pruned, nil
+}
+
+// pruneAtomsIfUnused deletes any of atoms that aren't referenced by a molecule
+// (or mounted, or pinned) from the db and from disk, returning the ones that
+// were deleted. If dryRun is true, nothing is deleted.
+func (atomfs *Instance) pruneAtomsIfUnused(atoms []types.Atom, dryRun bool) ([]types.Atom, error) {
+	pruned := []types.Atom{}
+	seen := map[int64]bool{}
+
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return pruned, err
+	}
+
+	for _, atom := range atoms {
+		if seen[atom.ID] {
+			continue
+		}
+		seen[atom.ID] = true
+
+		refs, err := atomfs.db.CountAtomReferences(atom.ID)
+		if err != nil {
+			return pruned, err
+		}
+
+		if refs > 0 || mounted[atom.Hash] || atom.Pinned {
+			continue
+		}
+
+		if !dryRun {
+			if err := atomfs.db.DeleteThing(atom.ID, "atom"); err != nil {
+				return pruned, err
+			}
+
+			err := atomfs.storage.Remove(atom.FileName())
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return pruned, err
+			}
+		}
+
+		pruned = append(pruned, atom)
+	}
+
+	return pruned, nil
+}
+
+// liveChunkFiles returns the file names of the chunks in users (see
+// db.GetChunkUsers) that are used by an atom that isn't in pruned.
+func liveChunkFiles(users map[string][]int64, pruned []types.Atom) map[string]bool {
+	prunedIDs := map[int64]bool{}
+	for _, atom := range pruned {
+		prunedIDs[atom.ID] = true
+	}
+
+	live := map[string]bool{}
+	for hash, ids := range users {
+		for _, id := range ids {
+			if !prunedIDs[id] {
+				live[types.Chunk{Hash: hash}.FileName()] = true
+				break
+			}
+		}
+	}
+
+	return live
+}
+
+// orphanedAtomFiles returns the names of the files in onDisk (relative to the
+// atoms directory) that don't correspond to an atom in inDB, treating any
+// atom in pruned as though it was not in inDB.
+func orphanedAtomFiles(onDisk []string, inDB []types.Atom, pruned []types.Atom) []string {
+	known := make(map[string]struct{}, len(inDB))
+	for _, atom := range inDB {
+		known[atom.FileName()] = struct{}{}
+	}
+
+	for _, atom := range pruned {
+		delete(known, atom.FileName())
+	}
+
+	orphans := []string{}
+	for _, name := range onDisk {
+		if _, ok := known[name]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+
+	return orphans
+}
@@ -0,0 +1,250 @@
+package atomfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func makeGCFixture(n int) ([]string, []types.Atom) {
+	onDisk := []string{}
+	inDB := []types.Atom{}
+	for i := 0; i < n; i++ {
+		hash := fmt.Sprintf("%064x", i)
+		onDisk = append(onDisk, hash)
+		// leave every tenth atom orphaned
+		if i%10 != 0 {
+			inDB = append(inDB, types.Atom{ID: int64(i), Hash: hash})
+		}
+	}
+
+	return onDisk, inDB
+}
+
+func TestOrphanedAtomFiles(t *testing.T) {
+	onDisk, inDB := makeGCFixture(100)
+
+	orphans := orphanedAtomFiles(onDisk, inDB, nil)
+	if len(orphans) != 10 {
+		t.Fatalf("expected 10 orphans, got %d", len(orphans))
+	}
+
+	orphans = orphanedAtomFiles(onDisk, inDB, inDB[:5])
+	if len(orphans) != 15 {
+		t.Fatalf("expected 15 orphans with pruned atoms, got %d", len(orphans))
+	}
+}
+
+func TestGCEmptyMolecules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-gc-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("empty", nil); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	report, err := atomfs.GCReport(false)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(report.EmptyMolecules) != 0 {
+		t.Fatalf("gc without EmptyMolecules deleted molecules")
+	}
+
+	report, err = atomfs.GCWithOptions(GCOptions{EmptyMolecules: true})
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(report.EmptyMolecules) != 1 || report.EmptyMolecules[0].Name != "empty" {
+		t.Fatalf("expected molecule empty to be collected, got %v", report.EmptyMolecules)
+	}
+
+	if _, err := atomfs.GetMolecule("empty"); err == nil {
+		t.Fatalf("empty molecule still exists after gc")
+	}
+}
+
+func TestGCToSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-gc-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	content := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	chunked, err := atomfs.ImportAtomChunked(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("couldn't import chunked atom %s", err)
+	}
+
+	atoms := []types.Atom{}
+	for _, content := range []string{"aaa", "bbb", "ccc"} {
+		atom, err := atomfs.ImportAtom(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("couldn't import atom %s", err)
+		}
+		atoms = append(atoms, atom)
+	}
+
+	// Using aaa (by importing it again) and bbb (by opening it) makes
+	// the chunked atom and ccc the least recently used.
+	time.Sleep(10 * time.Millisecond)
+	if _, err := atomfs.ImportAtom(strings.NewReader("aaa")); err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+	readAtom(t, atomfs, atoms[1])
+
+	maxBytes := int64(0)
+	for _, atom := range atoms[:2] {
+		fi, err := atomfs.storage.Stat(atom.FileName())
+		if err != nil {
+			t.Fatalf("couldn't stat atom %s", err)
+		}
+		maxBytes += fi.Size
+	}
+
+	pruned, err := atomfs.GCToSize(maxBytes)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(pruned) != 2 || pruned[0].Hash != chunked.Hash || pruned[1].Hash != atoms[2].Hash {
+		t.Fatalf("expected the chunked atom and ccc to be pruned, got %v", pruned)
+	}
+
+	// The chunks went along with their atom.
+	files, err := atomfs.storage.List()
+	if err != nil {
+		t.Fatalf("couldn't list atoms %s", err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("expected only aaa and bbb to be left, got %v", files)
+	}
+}
+
+func TestGCToSizeLinkedAtoms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-gc-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: path.Join(dir, "store")})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	// The file is on the same filesystem as the store, so it is imported
+	// as a hard link, whose space isn't freed by pruning the atom.
+	outside := path.Join(dir, "foo")
+	if err := ioutil.WriteFile(outside, []byte("foo"), 0644); err != nil {
+		t.Fatalf("couldn't write file %s", err)
+	}
+
+	linked, err := atomfs.ImportAtomFromPath(outside)
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	fi, err := os.Stat(outside)
+	if err != nil {
+		t.Fatalf("couldn't stat file %s", err)
+	}
+
+	if fi.Sys().(*syscall.Stat_t).Nlink != 2 {
+		t.Skip("the atom was copied rather than linked")
+	}
+
+	if _, err := atomfs.ImportAtom(strings.NewReader("bar")); err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	atoms, reclaimable, err := atomfs.UnusedAtomsReport()
+	if err != nil {
+		t.Fatalf("couldn't report unused atoms %s", err)
+	}
+
+	if len(atoms) != 2 || reclaimable != 3 {
+		t.Fatalf("expected two unused atoms and only bar's 3 bytes reclaimable, got %v and %d", atoms, reclaimable)
+	}
+
+	// Pruning the linked atom (which is the least recently used) doesn't
+	// get the store down to 3 bytes, so bar has to go too.
+	pruned, err := atomfs.GCToSize(3)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(pruned) != 2 || pruned[0].Hash != linked.Hash {
+		t.Fatalf("expected both atoms to be pruned, got %v", pruned)
+	}
+
+	content, err := ioutil.ReadFile(outside)
+	if err != nil || string(content) != "foo" {
+		t.Fatalf("pruning the atom broke the file it was linked to: %v", err)
+	}
+}
+
+// quadraticOrphanedAtomFiles is the old nested-loop implementation, kept
+// here so the benchmarks can show the difference.
+func quadraticOrphanedAtomFiles(onDisk []string, inDB []types.Atom) []string {
+	orphans := []string{}
+	for _, name := range onDisk {
+		found := false
+		for _, atom := range inDB {
+			if name == atom.Hash {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			orphans = append(orphans, name)
+		}
+	}
+
+	return orphans
+}
+
+func BenchmarkOrphanedAtomFiles(b *testing.B) {
+	onDisk, inDB := makeGCFixture(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		orphanedAtomFiles(onDisk, inDB, nil)
+	}
+}
+
+func BenchmarkQuadraticOrphanedAtomFiles(b *testing.B) {
+	onDisk, inDB := makeGCFixture(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		quadraticOrphanedAtomFiles(onDisk, inDB)
+	}
+}
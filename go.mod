@@ -2,8 +2,11 @@ module github.com/anuvu/atomfs
 
 require (
 	github.com/anuvu/stacker v0.4.1-0.20190607155931-46d8ec0d501e
+	github.com/containers/image v1.5.1
+	github.com/klauspost/compress v1.11.4
 	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/openSUSE/umoci v0.4.4
+	github.com/opencontainers/go-digest v1.0.0-rc1
 	github.com/opencontainers/image-spec v1.0.1
 	github.com/pkg/errors v0.8.1
 	github.com/schollz/sqlite3dump v1.2.4
@@ -0,0 +1,73 @@
+package atomfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/anuvu/atomfs/storage"
+	"github.com/anuvu/atomfs/types"
+)
+
+var (
+	// ErrDBUnhealthy is returned (wrapped) by Healthy when the db doesn't
+	// respond to a query. It is the same error as types.ErrDBUnhealthy.
+	ErrDBUnhealthy = types.ErrDBUnhealthy
+	// ErrAtomsDirUnhealthy is returned (wrapped) by Healthy when the atoms
+	// directory is missing, or can't be written to. It is the same error
+	// as types.ErrAtomsDirUnhealthy.
+	ErrAtomsDirUnhealthy = types.ErrAtomsDirUnhealthy
+)
+
+// healthCheckTimeout is how long Healthy waits for the db.
+const healthCheckTimeout = 2 * time.Second
+
+// Healthy is a cheap check that the store is usable, meant for things like
+// liveness probes: it runs a trivial query against the db, and checks that
+// the atoms directory exists (if the atoms are stored locally) and (unless the
+// store is read only) that the atom storage can be written to. Nothing is
+// hashed or locked, so it returns quickly even while a GC or an FSCK is
+// running.
+func (atomfs *Instance) Healthy() error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	if err := atomfs.db.Ping(ctx); err != nil {
+		return fmt.Errorf("%w: %v", ErrDBUnhealthy, err)
+	}
+
+	// Other storages may not have a directory at all; for them, the probe
+	// below is the whole check.
+	if _, ok := atomfs.storage.(*storage.Local); ok {
+		fi, err := os.Stat(atomfs.config.AtomsPath())
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrAtomsDirUnhealthy, err)
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("%w: %s is not a directory", ErrAtomsDirUnhealthy, atomfs.config.AtomsPath())
+		}
+	}
+
+	if atomfs.config.ReadOnly {
+		return nil
+	}
+
+	w, err := atomfs.storage.Create()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAtomsDirUnhealthy, err)
+	}
+
+	if err := w.Abort(); err != nil {
+		return fmt.Errorf("%w: %v", ErrAtomsDirUnhealthy, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package atomfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestHealthy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-health-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+	defer atomfs.Close()
+
+	if err := atomfs.Healthy(); err != nil {
+		t.Fatalf("new store isn't healthy %s", err)
+	}
+
+	// The probe shouldn't leave anything behind.
+	files, err := atomfs.storage.List()
+	if err != nil {
+		t.Fatalf("couldn't list atoms %s", err)
+	}
+
+	if len(files) != 0 {
+		t.Fatalf("health check left files behind %v", files)
+	}
+
+	if err := os.RemoveAll(atomfs.config.AtomsPath()); err != nil {
+		t.Fatalf("couldn't remove atoms dir %s", err)
+	}
+
+	if err := atomfs.Healthy(); !errors.Is(err, ErrAtomsDirUnhealthy) {
+		t.Fatalf("bad error without an atoms dir: %v", err)
+	}
+}
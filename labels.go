@@ -0,0 +1,47 @@
+package atomfs
+
+import (
+	"github.com/anuvu/atomfs/types"
+)
+
+// SetMoleculeLabel labels the molecule called name with key=value, replacing
+// any existing value for key. Labels are deleted along with their molecule.
+func (atomfs *Instance) SetMoleculeLabel(name string, key string, value string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.db.SetMoleculeLabel(name, key, value)
+}
+
+// GetMoleculeLabels returns the labels of the molecule called name.
+func (atomfs *Instance) GetMoleculeLabels(name string) (map[string]string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if _, err := atomfs.db.GetMolecule(name); err != nil {
+		return nil, err
+	}
+
+	return atomfs.db.GetMoleculeLabels(name)
+}
+
+// FindMoleculesByLabel returns all of the molecules labeled key=value.
+func (atomfs *Instance) FindMoleculesByLabel(key string, value string) ([]types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return atomfs.db.FindMoleculesByLabel(key, value)
+}
@@ -0,0 +1,99 @@
+package atomfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/anuvu/atomfs/types"
+	"golang.org/x/sys/unix"
+)
+
+// ErrLocked is returned when the store's lock couldn't be taken within
+// Config.LockTimeout because another process holds it, or when the db stays
+// busy for longer than Config.Retry allows. It is the same error as
+// types.ErrLocked.
+var ErrLocked = types.ErrLocked
+
+// lockRetryInterval is how often a contended lock is retried.
+const lockRetryInterval = 100 * time.Millisecond
+
+// lock takes the store's lock file, shared or exclusive, returning a function
+// that releases it.
+//
+// Operations that add atom files (e.g. ImportAtom) or read all of them (e.g.
+// FSCK) take the lock shared, so that they can run alongside each other, and
+// operations that delete atom files (e.g. GC) take it exclusive, so that they
+// can't delete an atom that is in the middle of being imported or checked.
+//
+// Each call opens the lock file anew, and flock() locks belong to the open
+// file rather than the process, so this excludes other operations in the
+// same process just as it does ones in other processes.
+//
+// The Instance isn't closed until the lock is released; if it already has
+// been, lock fails with ErrClosed.
+func (atomfs *Instance) lock(exclusive bool) (func(), error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	unlock, err := atomfs.flock(exclusive)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	return func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// flock takes the lock file itself; see lock.
+func (atomfs *Instance) flock(exclusive bool) (func(), error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if atomfs.config.ReadOnly {
+		flags = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(atomfs.config.RelativePath("atomfs.lock"), flags, 0644)
+	if err != nil {
+		// Nobody has ever written to this store, so there's nobody
+		// to exclude.
+		if atomfs.config.ReadOnly && os.IsNotExist(err) {
+			return func() {}, nil
+		}
+		return nil, err
+	}
+
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+
+	deadline := time.Now().Add(atomfs.config.LockTimeout)
+	for {
+		err = unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%w: %s", ErrLocked, atomfs.config.Path)
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+
+	return func() {
+		// closing the file drops the lock
+		f.Close()
+	}, nil
+}
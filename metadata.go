@@ -0,0 +1,333 @@
+package atomfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/anuvu/atomfs/db"
+	"github.com/anuvu/atomfs/types"
+)
+
+// metadataVersion is the version of the format written by ExportMetadata.
+const metadataVersion = 1
+
+// metadata is the JSON document written by ExportMetadata.
+type metadata struct {
+	Version   int                `json:"version"`
+	Atoms     []metadataAtom     `json:"atoms"`
+	Molecules []metadataMolecule `json:"molecules"`
+}
+
+type metadataAtom struct {
+	Name        string                `json:"name"`
+	Hash        string                `json:"hash"`
+	Type        types.AtomType        `json:"type"`
+	Algorithm   types.DigestAlgorithm `json:"algorithm"`
+	Compression types.Compression     `json:"compression"`
+	Size        *int64                `json:"size,omitempty"`
+	MediaType   string                `json:"mediaType,omitempty"`
+	Chunked     bool                  `json:"chunked,omitempty"`
+	KeyID       string                `json:"keyID,omitempty"`
+	Chunks      []metadataChunk       `json:"chunks,omitempty"`
+}
+
+type metadataChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+type metadataMolecule struct {
+	Name string `json:"name"`
+	// Atoms are the hashes of the molecule's atoms, top most first.
+	Atoms  []string          `json:"atoms"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// ExportMetadata writes a JSON description of every atom and molecule in the
+// store (but not the atoms' contents, or any mounts) to w. ImportMetadata
+// reads it back. Everything is read from one snapshot of the db, so the
+// document is consistent even if the store is changed while it is exported.
+func (atomfs *Instance) ExportMetadata(w io.Writer) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	md := metadata{}
+	err = atomfs.db.InSnapshot(func(snap *db.AtomfsDB) error {
+		var err error
+		md, err = exportMetadata(snap)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(md)
+}
+
+// exportMetadata reads the description of the store that ExportMetadata
+// writes from snap.
+func exportMetadata(snap *db.AtomfsDB) (metadata, error) {
+	md := metadata{Version: metadataVersion, Atoms: []metadataAtom{}, Molecules: []metadataMolecule{}}
+
+	// Atoms' chunks are looked up as we go, so don't hold a query over
+	// the atoms open while doing it.
+	atoms, err := snap.GetAtoms()
+	if err != nil {
+		return metadata{}, err
+	}
+
+	for _, atom := range atoms {
+		ma := metadataAtom{
+			Name:        atom.Name,
+			Hash:        atom.Hash,
+			Type:        atom.Type,
+			Algorithm:   atom.Algorithm,
+			Compression: atom.Compression,
+			MediaType:   atom.MediaType,
+			Chunked:     atom.Chunked,
+			KeyID:       atom.KeyID,
+		}
+
+		if atom.SizeKnown {
+			size := atom.Size
+			ma.Size = &size
+		}
+
+		if atom.Chunked {
+			chunks, err := snap.GetAtomChunks(atom.ID)
+			if err != nil {
+				return metadata{}, err
+			}
+
+			ma.Chunks = []metadataChunk{}
+			for _, c := range chunks {
+				ma.Chunks = append(ma.Chunks, metadataChunk{c.Hash, c.Size})
+			}
+		}
+
+		md.Atoms = append(md.Atoms, ma)
+	}
+
+	mols, err := snap.GetMolecules()
+	if err != nil {
+		return metadata{}, err
+	}
+
+	for _, mol := range mols {
+		labels, err := snap.GetMoleculeLabels(mol.Name)
+		if err != nil {
+			return metadata{}, err
+		}
+
+		md.Molecules = append(md.Molecules, metadataMolecule{mol.Name, atomHashes(mol.Atoms), labels})
+	}
+
+	return md, nil
+}
+
+// ImportMetadata adds the atoms and molecules described by a document written
+// by ExportMetadata to the store, in a single transaction. Only the db is
+// changed: the atoms' files are expected to be put in place separately, and
+// a warning is logged for each one that isn't there yet. Atoms that already
+// exist are left alone, but the import fails if they don't match the
+// document, as it does for atoms whose names or hashes aren't valid. Molecules
+// that already exist are changed to match the document, so importing the same
+// document twice is harmless.
+func (atomfs *Instance) ImportMetadata(r io.Reader) error {
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	md := metadata{}
+	if err := json.NewDecoder(r).Decode(&md); err != nil {
+		return err
+	}
+
+	if md.Version != metadataVersion {
+		return fmt.Errorf("unsupported metadata version %d", md.Version)
+	}
+
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return atomfs.inTx(func(inTx *Instance) error {
+		for _, ma := range md.Atoms {
+			if err := inTx.importMetadataAtom(ma); err != nil {
+				return err
+			}
+		}
+
+		for _, mm := range md.Molecules {
+			if err := inTx.importMetadataMolecule(mm); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// importMetadataAtom adds the atom described by ma, unless the store already
+// has it. The document may come from anywhere, so its names and hashes are
+// checked before they are used as file names, its types and compressions must
+// be ones we know how to read, and an atom that is already in the store must
+// match it.
+func (atomfs *Instance) importMetadataAtom(ma metadataAtom) error {
+	if ma.Name != ma.Hash {
+		return fmt.Errorf("atom %q is named %q, rather than after its hash", ma.Hash, ma.Name)
+	}
+
+	if err := (types.Digest{Algorithm: ma.Algorithm, Hash: ma.Hash}).Validate(); err != nil {
+		return fmt.Errorf("bad atom %q: %w", ma.Hash, err)
+	}
+
+	if ma.Type != types.TarAtom && ma.Type != types.SquashfsAtom {
+		return fmt.Errorf("atom %s has unknown type %q", ma.Hash, ma.Type)
+	}
+
+	switch ma.Compression {
+	case "", types.NoCompression, types.GzipCompression, types.ZstdCompression:
+	default:
+		return fmt.Errorf("atom %s has unknown compression %q", ma.Hash, ma.Compression)
+	}
+
+	if !ma.Chunked && len(ma.Chunks) > 0 {
+		return fmt.Errorf("atom %s has chunks, but isn't chunked", ma.Hash)
+	}
+
+	for _, mc := range ma.Chunks {
+		if err := (types.Digest{Algorithm: types.SHA256, Hash: mc.Hash}).Validate(); err != nil {
+			return fmt.Errorf("bad chunk of atom %s: %w", ma.Hash, err)
+		}
+	}
+
+	atom := types.Atom{
+		Name:        ma.Name,
+		Hash:        ma.Hash,
+		Type:        ma.Type,
+		Algorithm:   ma.Algorithm,
+		Compression: ma.Compression,
+		MediaType:   ma.MediaType,
+		Chunked:     ma.Chunked,
+		KeyID:       ma.KeyID,
+	}
+
+	if ma.Size != nil {
+		atom.Size = *ma.Size
+		atom.SizeKnown = true
+	}
+
+	files := []string{atom.FileName()}
+	chunks := []types.Chunk{}
+	if atom.Chunked {
+		files = []string{}
+		for _, mc := range ma.Chunks {
+			chunk := types.Chunk{Hash: mc.Hash, Size: mc.Size}
+			chunks = append(chunks, chunk)
+			files = append(files, chunk.FileName())
+		}
+	}
+
+	existing, ok, err := atomfs.db.GetAtomByHash(atom.Hash)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		return atomfs.checkMetadataAtom(existing, atom, chunks)
+	}
+
+	for _, name := range files {
+		_, err := atomfs.storage.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			atomfs.log().Warn("imported atom isn't on disk", "hash", atom.Hash, "file", name)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	_, err = atomfs.db.AddAtomRecord(atom, chunks)
+	return err
+}
+
+// checkMetadataAtom fails if existing, an atom that is already in the store,
+// doesn't match the description of it in an imported document.
+func (atomfs *Instance) checkMetadataAtom(existing types.Atom, atom types.Atom, chunks []types.Chunk) error {
+	if existing.Digest().String() != atom.Digest().String() {
+		return fmt.Errorf("atom %s is already in the store as %s", atom.Digest(), existing.Digest())
+	}
+
+	if existing.Type != atom.Type {
+		return fmt.Errorf("atom %s is %s in the store, but %s in the document", atom.Hash, existing.Type, atom.Type)
+	}
+
+	if existing.Chunked != atom.Chunked {
+		return fmt.Errorf("atom %s is chunked in only one of the store and the document", atom.Hash)
+	}
+
+	if !existing.Chunked {
+		return nil
+	}
+
+	existingChunks, err := atomfs.db.GetAtomChunks(existing.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(existingChunks) != len(chunks) {
+		return fmt.Errorf("atom %s has %d chunks in the store, but %d in the document", atom.Hash, len(existingChunks), len(chunks))
+	}
+
+	for i := range chunks {
+		if existingChunks[i] != chunks[i] {
+			return fmt.Errorf("chunk %d of atom %s is %s in the store, but %s in the document", i, atom.Hash, existingChunks[i].Hash, chunks[i].Hash)
+		}
+	}
+
+	return nil
+}
+
+func (atomfs *Instance) importMetadataMolecule(mm metadataMolecule) error {
+	atoms := []types.Atom{}
+	for _, hash := range mm.Atoms {
+		atom, ok, err := atomfs.db.GetAtomByHash(hash)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return fmt.Errorf("%w: molecule %s uses %s", types.ErrAtomNotFound, mm.Name, hash)
+		}
+
+		atoms = append(atoms, atom)
+	}
+
+	existing, err := atomfs.db.GetMolecule(mm.Name)
+	if errors.Is(err, types.ErrMoleculeNotFound) {
+		_, err = atomfs.createMolecule(mm.Name, atoms)
+	} else if err == nil && !sameAtoms(existing.Atoms, atoms) {
+		_, err = atomfs.updateMolecule(existing, atoms)
+	}
+	if err != nil {
+		return err
+	}
+
+	for key, value := range mm.Labels {
+		if err := atomfs.db.SetMoleculeLabel(mm.Name, key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package atomfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func openTestStore(t *testing.T) (*Instance, func()) {
+	dir, err := ioutil.TempDir("", "atomfs-metadata-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	return atomfs, func() {
+		atomfs.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	src, cleanup := openTestStore(t)
+	defer cleanup()
+
+	foo, err := src.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	content := make([]byte, 6*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	chunked, err := src.ImportAtomChunked(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("couldn't import chunked atom %s", err)
+	}
+
+	if _, err := src.CreateMolecule("both", []types.Atom{chunked, foo}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if err := src.SetMoleculeLabel("both", "role", "base"); err != nil {
+		t.Fatalf("couldn't label molecule %s", err)
+	}
+
+	exported := bytes.Buffer{}
+	if err := src.ExportMetadata(&exported); err != nil {
+		t.Fatalf("couldn't export metadata %s", err)
+	}
+
+	dest, cleanup := openTestStore(t)
+	defer cleanup()
+
+	// Importing the same document twice is harmless.
+	for i := 0; i < 2; i++ {
+		if err := dest.ImportMetadata(bytes.NewReader(exported.Bytes())); err != nil {
+			t.Fatalf("couldn't import metadata %s", err)
+		}
+	}
+
+	mol, err := dest.GetMolecule("both")
+	if err != nil {
+		t.Fatalf("couldn't get molecule %s", err)
+	}
+
+	if len(mol.Atoms) != 2 || mol.Atoms[0].Hash != chunked.Hash || mol.Atoms[1].Hash != foo.Hash {
+		t.Fatalf("molecule has the wrong atoms %v", mol.Atoms)
+	}
+
+	if !mol.Atoms[0].Chunked {
+		t.Fatalf("chunked atom isn't chunked after import")
+	}
+
+	labels, err := dest.GetMoleculeLabels("both")
+	if err != nil {
+		t.Fatalf("couldn't get labels %s", err)
+	}
+
+	if len(labels) != 1 || labels["role"] != "base" {
+		t.Fatalf("bad labels after import %v", labels)
+	}
+
+	srcChunks, err := src.db.GetAtomChunks(chunked.ID)
+	if err != nil {
+		t.Fatalf("couldn't get chunks %s", err)
+	}
+
+	destChunks, err := dest.db.GetAtomChunks(mol.Atoms[0].ID)
+	if err != nil {
+		t.Fatalf("couldn't get chunks %s", err)
+	}
+
+	if len(srcChunks) != len(destChunks) {
+		t.Fatalf("chunked atom has %d chunks after import, not %d", len(destChunks), len(srcChunks))
+	}
+
+	for i := range srcChunks {
+		if srcChunks[i] != destChunks[i] {
+			t.Fatalf("chunk %d changed from %v to %v", i, srcChunks[i], destChunks[i])
+		}
+	}
+
+	// And exporting the imported store gives the same document.
+	reexported := bytes.Buffer{}
+	if err := dest.ExportMetadata(&reexported); err != nil {
+		t.Fatalf("couldn't export metadata %s", err)
+	}
+
+	if !bytes.Equal(exported.Bytes(), reexported.Bytes()) {
+		t.Fatalf("metadata changed on the way through:\n%s\n%s", exported.String(), reexported.String())
+	}
+}
+
+func TestImportMetadataRejectsUnknown(t *testing.T) {
+	src, cleanup := openTestStore(t)
+	defer cleanup()
+
+	if _, err := src.ImportAtom(strings.NewReader("foo")); err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	exported := bytes.Buffer{}
+	if err := src.ExportMetadata(&exported); err != nil {
+		t.Fatalf("couldn't export metadata %s", err)
+	}
+
+	for _, mangle := range []func(*metadataAtom){
+		func(ma *metadataAtom) { ma.Type = "zip" },
+		func(ma *metadataAtom) { ma.Compression = "lz4" },
+	} {
+		md := metadata{}
+		if err := json.Unmarshal(exported.Bytes(), &md); err != nil {
+			t.Fatalf("couldn't parse metadata %s", err)
+		}
+		mangle(&md.Atoms[0])
+
+		doc, err := json.Marshal(md)
+		if err != nil {
+			t.Fatalf("couldn't encode metadata %s", err)
+		}
+
+		dest, cleanup := openTestStore(t)
+		defer cleanup()
+
+		if err := dest.ImportMetadata(bytes.NewReader(doc)); err == nil {
+			t.Fatalf("imported a bad atom %v", md.Atoms[0])
+		}
+
+		count, err := dest.CountAtoms()
+		if err != nil {
+			t.Fatalf("couldn't count atoms %s", err)
+		}
+
+		if count != 0 {
+			t.Fatalf("failed import left %d atoms behind", count)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package atomfs
+
+import (
+	"time"
+)
+
+// Metrics receives measurements of the operations an Instance does. Op and
+// counter names are the Op* and Counter* constants below, so that they can be
+// mapped directly onto e.g. Prometheus metrics. It must be safe for concurrent
+// use.
+type Metrics interface {
+	// ObserveDuration is called with how long an operation took, whether
+	// or not it succeeded.
+	ObserveDuration(op string, d time.Duration)
+	// IncCounter is called to add n to the named counter.
+	IncCounter(name string, n int)
+}
+
+const (
+	OpFSCK       = "fsck"
+	OpGC         = "gc"
+	OpImportAtom = "import_atom"
+
+	CounterFSCKAtoms     = "fsck_atoms"
+	CounterFSCKErrors    = "fsck_errors"
+	CounterGCPrunedAtoms = "gc_pruned_atoms"
+	CounterGCFiles       = "gc_removed_files"
+	CounterImportedAtoms = "imported_atoms"
+)
+
+// SetMetrics sets the Metrics that operations are reported to. Passing nil
+// disables metrics. This should be called before the Instance is used
+// concurrently.
+func (atomfs *Instance) SetMetrics(m Metrics) {
+	atomfs.metrics = m
+}
+
+// observe reports the time since start as the duration of op; it is meant to
+// be deferred.
+func (atomfs *Instance) observe(op string, start time.Time) {
+	if atomfs.metrics == nil {
+		return
+	}
+
+	atomfs.metrics.ObserveDuration(op, time.Since(start))
+}
+
+func (atomfs *Instance) count(name string, n int) {
+	if atomfs.metrics == nil || n == 0 {
+		return
+	}
+
+	atomfs.metrics.IncCounter(name, n)
+}
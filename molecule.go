@@ -1,67 +1,783 @@
 package atomfs
 
 import (
-	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/anuvu/atomfs/types"
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/openSUSE/umoci/oci/casext"
 )
 
+// CreateMolecule creates a molecule called name made of atoms, failing with an
+// error wrapping types.ErrMoleculeExists if there already is one.
 func (atomfs *Instance) CreateMolecule(name string, atoms []types.Atom) (types.Molecule, error) {
-	return atomfs.db.CreateMolecule(name, atoms)
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	return atomfs.createMolecule(name, atoms)
+}
+
+// CreateMoleculeFromHashes creates a molecule from the atoms with the given
+// hashes, in order. It fails without creating anything if any of the atoms
+// don't exist.
+func (atomfs *Instance) CreateMoleculeFromHashes(name string, atomHashes []string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	atoms, err := atomfs.lookupAtoms(atomHashes)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	return atomfs.createMolecule(name, atoms)
+}
+
+// lookupAtoms is like PreviewMolecule, but fails with an error wrapping
+// types.ErrAtomNotFound if any of the atoms are missing.
+func (atomfs *Instance) lookupAtoms(atomHashes []string) ([]types.Atom, error) {
+	atoms, missing, err := atomfs.PreviewMolecule(atomHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%w: %s", types.ErrAtomNotFound, missing[0])
+	}
+
+	return atoms, nil
+}
+
+// PreviewMolecule looks up the atoms that a molecule made of atomHashes would
+// reference, without creating anything. Atoms that are in the db and on disk
+// are returned in order in present; the hashes of any that aren't are
+// returned in missing.
+func (atomfs *Instance) PreviewMolecule(atomHashes []string) ([]types.Atom, []string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	present := []types.Atom{}
+	missing := []string{}
+	for _, hash := range atomHashes {
+		atom, ok, err := atomfs.db.GetAtomByHash(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if ok && atom.Chunked {
+			chunks, cErr := atomfs.missingChunks(atom)
+			if cErr != nil {
+				return nil, nil, cErr
+			}
+
+			if len(chunks) > 0 {
+				err = os.ErrNotExist
+			}
+		} else if ok {
+			_, err = atomfs.storage.Stat(atom.FileName())
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, nil, err
+			}
+		}
+
+		if !ok || err != nil {
+			missing = append(missing, hash)
+			continue
+		}
+
+		present = append(present, atom)
+	}
+
+	return present, missing, nil
+}
+
+// PreviewCopyMolecule is PreviewMolecule for the atoms that CopyMolecule would
+// give a copy of src.
+func (atomfs *Instance) PreviewCopyMolecule(src string) ([]types.Atom, []string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	mol, err := atomfs.db.GetMolecule(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return atomfs.PreviewMolecule(atomHashes(mol.Atoms))
+}
+
+// PreviewMergeMolecules is PreviewMolecule for the atoms that MergeMolecules
+// would give a merge of sources.
+func (atomfs *Instance) PreviewMergeMolecules(sources ...string) ([]types.Atom, []string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	atoms, err := atomfs.mergedAtoms(sources)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return atomfs.PreviewMolecule(atomHashes(atoms))
+}
+
+func atomHashes(atoms []types.Atom) []string {
+	hashes := []string{}
+	for _, atom := range atoms {
+		hashes = append(hashes, atom.Hash)
+	}
+	return hashes
+}
+
+// createMolecule creates a molecule and emits an event for it.
+func (atomfs *Instance) createMolecule(name string, atoms []types.Atom) (types.Molecule, error) {
+	mol, err := atomfs.db.CreateMolecule(name, atoms)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	atomfs.emit(MoleculeCreated, name, "")
+	return mol, nil
+}
+
+// EnsureMolecule makes the molecule called name consist of the atoms with the
+// given hashes, in order: it is created if it doesn't exist, and its atoms are
+// replaced if they're different. The bool return is false if the molecule
+// already matched, in which case nothing was changed.
+func (atomfs *Instance) EnsureMolecule(name string, atomHashes []string) (types.Molecule, bool, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, false, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, false, err
+	}
+
+	mol := types.Molecule{}
+	changed := false
+	err = atomfs.inTx(func(inTx *Instance) error {
+		atoms, err := inTx.lookupAtoms(atomHashes)
+		if err != nil {
+			return err
+		}
+
+		existing, err := inTx.db.GetMolecule(name)
+		if errors.Is(err, types.ErrMoleculeNotFound) {
+			changed = true
+			mol, err = inTx.createMolecule(name, atoms)
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		if sameAtoms(existing.Atoms, atoms) {
+			mol = existing
+			return nil
+		}
+
+		changed = true
+		mol, err = inTx.updateMolecule(existing, atoms)
+		return err
+	})
+	if err != nil {
+		return types.Molecule{}, false, err
+	}
+
+	return mol, changed, nil
+}
+
+// UpdateMolecule replaces the atoms of the molecule called name with the ones
+// with the given hashes, in order, keeping its identity (and labels). It fails
+// without changing anything if any of the atoms don't exist.
+func (atomfs *Instance) UpdateMolecule(name string, atomHashes []string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	mol := types.Molecule{}
+	err = atomfs.inTx(func(inTx *Instance) error {
+		atoms, err := inTx.lookupAtoms(atomHashes)
+		if err != nil {
+			return err
+		}
+
+		existing, err := inTx.db.GetMolecule(name)
+		if err != nil {
+			return err
+		}
+
+		mol, err = inTx.updateMolecule(existing, atoms)
+		return err
+	})
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	return mol, nil
+}
+
+// updateMolecule replaces mol's atoms and emits an event for it.
+func (atomfs *Instance) updateMolecule(mol types.Molecule, atoms []types.Atom) (types.Molecule, error) {
+	if err := atomfs.db.SetMoleculeAtoms(mol.ID, atoms); err != nil {
+		return types.Molecule{}, err
+	}
+
+	atomfs.emit(MoleculeUpdated, mol.Name, "")
+	mol.Atoms = atoms
+	return mol, nil
+}
+
+func sameAtoms(a, b []types.Atom) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+
+	return true
 }
 
 // CopyMolecule simply duplicates a molecule's configuration under a new name.
 // This is equivalent to a "snapshot" operation under other filesystems.
 func (atomfs *Instance) CopyMolecule(dest string, src string) (types.Molecule, error) {
-	mol, err := atomfs.db.GetMolecule(src)
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	copied, err := atomfs.db.CopyMolecule(dest, src)
 	if err != nil {
 		return types.Molecule{}, err
 	}
 
-	return atomfs.db.CreateMolecule(dest, mol.Atoms)
+	atomfs.emit(MoleculeCopied, dest, src)
+	return copied, nil
 }
 
+// MergeMolecules creates a new molecule dest containing the atoms of each of
+// the sources in order. If an atom appears more than once, only its last
+// occurrence is kept. Remember that the first atom in a molecule is the top
+// most layer of its overlay, so ordering matters.
+func (atomfs *Instance) MergeMolecules(dest string, sources ...string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	atoms, err := atomfs.mergedAtoms(sources)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	return atomfs.createMolecule(dest, atoms)
+}
+
+// mergedAtoms returns the atoms of a merge of sources; see MergeMolecules.
+func (atomfs *Instance) mergedAtoms(sources []string) ([]types.Atom, error) {
+	all := []types.Atom{}
+	for _, src := range sources {
+		mol, err := atomfs.db.GetMolecule(src)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, mol.Atoms...)
+	}
+
+	last := map[int64]int{}
+	for i, atom := range all {
+		last[atom.ID] = i
+	}
+
+	atoms := []types.Atom{}
+	for i, atom := range all {
+		if last[atom.ID] == i {
+			atoms = append(atoms, atom)
+		}
+	}
+
+	return atoms, nil
+}
+
+// DiffMolecules compares the atoms of molecules a and b by hash, returning the
+// atoms only in a, the atoms only in b, and the atoms they have in common.
+func (atomfs *Instance) DiffMolecules(a, b string) ([]types.Atom, []types.Atom, []types.Atom, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer release()
+
+	molA, err := atomfs.db.GetMolecule(a)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	molB, err := atomfs.db.GetMolecule(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	inA := map[string]bool{}
+	for _, atom := range molA.Atoms {
+		inA[atom.Hash] = true
+	}
+
+	inB := map[string]bool{}
+	for _, atom := range molB.Atoms {
+		inB[atom.Hash] = true
+	}
+
+	onlyInA := []types.Atom{}
+	common := []types.Atom{}
+	for _, atom := range molA.Atoms {
+		if inB[atom.Hash] {
+			common = append(common, atom)
+		} else {
+			onlyInA = append(onlyInA, atom)
+		}
+	}
+
+	onlyInB := []types.Atom{}
+	for _, atom := range molB.Atoms {
+		if !inA[atom.Hash] {
+			onlyInB = append(onlyInB, atom)
+		}
+	}
+
+	return onlyInA, onlyInB, common, nil
+}
+
+// SharedBytes compares the atoms of molecules a and b like DiffMolecules, but
+// returns how many bytes of atoms they share, and how many are only in a or
+// only in b. Sizes are as in UnusedAtomsReport, and an atom that a molecule
+// uses more than once is only counted once.
+func (atomfs *Instance) SharedBytes(a, b string) (shared, onlyA, onlyB int64, err error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer release()
+
+	onlyInA, onlyInB, common, err := atomfs.DiffMolecules(a, b)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if shared, err = atomfs.sumAtomBytes(common); err != nil {
+		return 0, 0, 0, err
+	}
+
+	if onlyA, err = atomfs.sumAtomBytes(onlyInA); err != nil {
+		return 0, 0, 0, err
+	}
+
+	if onlyB, err = atomfs.sumAtomBytes(onlyInB); err != nil {
+		return 0, 0, 0, err
+	}
+
+	return shared, onlyA, onlyB, nil
+}
+
+// sumAtomBytes returns the total size of atoms, counting each hash once.
+func (atomfs *Instance) sumAtomBytes(atoms []types.Atom) (int64, error) {
+	seen := map[string]bool{}
+	total := int64(0)
+	for _, atom := range atoms {
+		if seen[atom.Hash] {
+			continue
+		}
+		seen[atom.Hash] = true
+
+		size, err := atomfs.atomBytes(atom)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	return total, nil
+}
+
+// DeleteMolecule deletes the molecule called name. If
+// types.Config.DeleteGracePeriod is set, it is only hidden, and can be brought
+// back with RestoreMolecule until the grace period is over. A soft deleted
+// molecule that is still mounted isn't purged until it is unmounted.
 func (atomfs *Instance) DeleteMolecule(name string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
 	mol, err := atomfs.db.GetMolecule(name)
 	if err != nil {
 		return err
 	}
 
-	return atomfs.db.DeleteThing(mol.ID, "molecule")
+	return atomfs.deleteMolecule(mol)
 }
 
-func (atomfs *Instance) RenameMolecule(old, new_ string) error {
-	mol, err := atomfs.db.GetMolecule(old)
+// DeleteMolecules deletes all of the molecules called names in a single
+// transaction, returning the names of the ones that were deleted and why each
+// of the others couldn't be (e.g. because it doesn't exist). Failing to delete
+// one molecule doesn't stop the others from being deleted; err is only
+// non-nil if the transaction itself failed, in which case nothing was
+// deleted. Names that appear more than once are only deleted once.
+func (atomfs *Instance) DeleteMolecules(names []string) ([]string, map[string]error, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+
+	var deleted []string
+	var failed map[string]error
+	err = atomfs.inTx(func(inTx *Instance) error {
+		deleted = []string{}
+		failed = map[string]error{}
+		seen := map[string]bool{}
+
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			mol, err := inTx.db.GetMolecule(name)
+			if err == nil {
+				err = inTx.deleteMolecule(mol)
+			}
+			if err != nil {
+				failed[name] = err
+				continue
+			}
+
+			deleted = append(deleted, name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return deleted, failed, nil
+}
+
+// deleteMolecule deletes (or soft deletes) mol and emits an event for it.
+func (atomfs *Instance) deleteMolecule(mol types.Molecule) error {
+	var err error
+	if atomfs.config.DeleteGracePeriod > 0 {
+		err = atomfs.db.SoftDeleteMolecule(mol.ID)
+	} else {
+		err = atomfs.db.DeleteThing(mol.ID, "molecule")
+	}
 	if err != nil {
 		return err
 	}
-	return atomfs.db.RenameThing(mol.ID, "molecule", new_)
+
+	atomfs.emit(MoleculeDeleted, mol.Name, "")
+	return nil
 }
 
-func (atomfs *Instance) CreateMoleculeFromOCITag(oci casext.Engine, name string) (types.Molecule, error) {
-	man, err := stackeroci.LookupManifest(oci, name)
+// RestoreMolecule brings back the molecule called name after it was deleted,
+// if that was within types.Config.DeleteGracePeriod. If it was deleted more
+// than once, the most recently deleted one is restored. It fails if another
+// molecule called name has been created since.
+func (atomfs *Instance) RestoreMolecule(name string) error {
+	release, err := atomfs.acquire()
 	if err != nil {
-		return types.Molecule{}, err
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-atomfs.config.DeleteGracePeriod)
+	if err := atomfs.db.RestoreMolecule(name, cutoff); err != nil {
+		return err
+	}
+
+	atomfs.emit(MoleculeRestored, name, "")
+	return nil
+}
+
+// PurgeDeleted permanently removes the soft deleted molecules whose grace
+// period is over (see types.Config.DeleteGracePeriod), and prunes any of their
+// atoms that aren't used by another molecule, returning the purged molecules
+// and the pruned atoms. GC purges them too.
+func (atomfs *Instance) PurgeDeleted() ([]types.Molecule, []types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+
+	unlock, err := atomfs.lock(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	purged, err := atomfs.purgeDeleted(false)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	atoms := []types.Atom{}
-	for _, l := range man.Layers {
-		layer, err := oci.FromDescriptor(context.Background(), l)
-		if err != nil {
-			return types.Molecule{}, err
+	for _, mol := range purged {
+		atoms = append(atoms, mol.Atoms...)
+	}
+
+	pruned, err := atomfs.pruneAtomsIfUnused(atoms, false)
+	return purged, pruned, err
+}
+
+// purgeDeleted permanently removes the soft deleted molecules whose grace
+// period is over, returning them. If dryRun is true, they're only returned.
+func (atomfs *Instance) purgeDeleted(dryRun bool) ([]types.Molecule, error) {
+	cutoff := time.Now().Add(-atomfs.config.DeleteGracePeriod)
+	expired, err := atomfs.db.GetMoleculesDeletedBefore(cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return expired, nil
+	}
+
+	for _, mol := range expired {
+		if err := atomfs.db.DeleteThing(mol.ID, "molecule"); err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// DeleteMoleculeAndGC deletes a molecule, and then immediately prunes any of
+// its atoms that aren't used by another molecule, returning the pruned atoms.
+// If the molecule is only soft deleted (see DeleteMolecule), its atoms are
+// still in use until it is purged, so none are pruned.
+func (atomfs *Instance) DeleteMoleculeAndGC(name string) ([]types.Atom, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	unlock, err := atomfs.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	mol, err := atomfs.db.GetMolecule(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := atomfs.deleteMolecule(mol); err != nil {
+		return nil, err
+	}
+
+	return atomfs.pruneAtomsIfUnused(mol.Atoms, false)
+}
+
+// PruneMoleculesOlderThan deletes the molecules that were created more than d
+// ago (other than mounted or pinned ones), and then prunes any of their atoms
+// that aren't used by another molecule. Molecules created by versions of atomfs
+// that didn't record creation times are never pruned. If dryRun is true,
+// nothing is deleted, but what would have been is still returned.
+func (atomfs *Instance) PruneMoleculesOlderThan(d time.Duration, dryRun bool) ([]types.Molecule, []types.Atom, error) {
+	if !dryRun {
+		if err := atomfs.checkWritable(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	unlock, err := atomfs.lock(!dryRun)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	mols, err := atomfs.db.GetMoleculesCreatedBefore(time.Now().Add(-d))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	atoms := []types.Atom{}
+	for _, mol := range mols {
+		atoms = append(atoms, mol.Atoms...)
+	}
+
+	if dryRun {
+		pruned, err := atomfs.atomsUnusedWithout(atoms)
+		return mols, pruned, err
+	}
+
+	err = atomfs.inTx(func(tx *Instance) error {
+		for _, mol := range mols {
+			if err := tx.db.DeleteThing(mol.ID, "molecule"); err != nil {
+				return err
+			}
+
+			tx.emit(MoleculeDeleted, mol.Name, "")
 		}
-		defer layer.Close()
 
-		atom, err := atomfs.CreateAtomFromOCIBlob(layer)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pruned, err := atomfs.pruneAtomsIfUnused(atoms, false)
+	return mols, pruned, err
+}
+
+// atomsUnusedWithout returns the atoms that would be unused (and so pruned) if
+// the references in refs were removed, e.g. because the molecules that hold
+// them were deleted.
+func (atomfs *Instance) atomsUnusedWithout(refs []types.Atom) ([]types.Atom, error) {
+	mounted, err := atomfs.mountedAtoms()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[int64]int{}
+	for _, atom := range refs {
+		counts[atom.ID]++
+	}
+
+	unused := []types.Atom{}
+	seen := map[int64]bool{}
+	for _, atom := range refs {
+		if seen[atom.ID] {
+			continue
+		}
+		seen[atom.ID] = true
+
+		total, err := atomfs.db.CountAtomReferences(atom.ID)
 		if err != nil {
-			return types.Molecule{}, err
+			return nil, err
 		}
 
-		atoms = append(atoms, atom)
+		if total <= counts[atom.ID] && !mounted[atom.Hash] && !atom.Pinned {
+			unused = append(unused, atom)
+		}
+	}
+
+	return unused, nil
+}
+
+// RenameMolecule atomically renames a molecule. It fails with an error
+// wrapping types.ErrMoleculeExists if a molecule named new_ already exists.
+func (atomfs *Instance) RenameMolecule(old, new_ string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := atomfs.db.RenameMolecule(old, new_); err != nil {
+		return err
+	}
+
+	atomfs.emit(MoleculeRenamed, new_, old)
+	return nil
+}
+
+func (atomfs *Instance) CreateMoleculeFromOCITag(oci casext.Engine, name string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	return atomfs.createMoleculeFromOCITag(oci, name, name)
+}
+
+// createMoleculeFromOCITag imports the image tagged tag in oci as a molecule
+// called name. Layers that are already atoms are reused.
+func (atomfs *Instance) createMoleculeFromOCITag(oci casext.Engine, tag string, name string) (types.Molecule, error) {
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
 	}
 
+	man, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	atoms, err := atomfs.importOCILayers(ociLayoutLayers(oci), man.Layers)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	return atomfs.createMoleculeFromLayers(name, atoms)
+}
+
+// createMoleculeFromLayers creates a molecule called name from the atoms for
+// an image's layers, which are in OCI order.
+func (atomfs *Instance) createMoleculeFromLayers(name string, atoms []types.Atom) (types.Molecule, error) {
 	// The OCI spec says that the first layer should be the bottom most
 	// layer. In overlay it's the top most layer. Since the atomfs codebase
 	// is mostly a wrapper around overlayfs, let's keep things in our db in
@@ -76,9 +792,91 @@ func (atomfs *Instance) CreateMoleculeFromOCITag(oci casext.Engine, name string)
 		atoms[i], atoms[opp] = atoms[opp], atoms[i]
 	}
 
-	return atomfs.db.CreateMolecule(name, atoms)
+	return atomfs.createMolecule(name, atoms)
 }
 
+// MoleculeDigest returns a digest of the molecule's atoms, e.g.
+// "sha256:1234...", which only depends on their digests and order: two
+// molecules (in any store, with any names and labels) have the same digest if
+// and only if they have the same atoms in the same order. It is the sha256 of
+// the atoms' digests, top most first, each followed by a newline.
+func (atomfs *Instance) MoleculeDigest(name string) (string, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	mol, err := atomfs.db.GetMolecule(name)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, atom := range mol.Atoms {
+		fmt.Fprintf(h, "%s\n", atom.Digest())
+	}
+
+	return types.Digest{Algorithm: types.SHA256, Hash: fmt.Sprintf("%x", h.Sum(nil))}.String(), nil
+}
+
+// MoleculesUsingAtom returns all of the molecules that reference the atom with
+// the given hash, i.e. the ones that would break if it was pruned.
+func (atomfs *Instance) MoleculesUsingAtom(hash string) ([]types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return atomfs.db.GetMoleculesUsingAtomHash(hash)
+}
+
+// ListMolecules returns all of the molecules in this atomfs, with their atoms
+// filled in.
+func (atomfs *Instance) ListMolecules() ([]types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return atomfs.db.GetMolecules()
+}
+
+// ListMoleculesPage returns up to limit molecules, skipping the first offset.
+// Molecules are ordered by id, i.e. the order they were created in, so new
+// molecules always land on the last page and pages don't otherwise shift
+// unless molecules are deleted.
+func (atomfs *Instance) ListMoleculesPage(offset int, limit int) ([]types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return atomfs.db.GetMoleculesPage(offset, limit)
+}
+
+// CountMolecules returns the number of molecules in the store.
+func (atomfs *Instance) CountMolecules() (int, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	return atomfs.db.CountMolecules()
+}
+
+// GetMolecule looks up a molecule and its atoms by name. If it doesn't exist,
+// the error wraps types.ErrMoleculeNotFound.
 func (atomfs *Instance) GetMolecule(name string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
 	return atomfs.db.GetMolecule(name)
 }
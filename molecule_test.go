@@ -1,9 +1,12 @@
 package atomfs
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/anuvu/atomfs/types"
 )
@@ -39,3 +42,147 @@ func TestRename(t *testing.T) {
 		t.Fatalf("molecule ids changed after rename")
 	}
 }
+
+func TestRenameExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-rename-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	_, err = atomfs.CreateMolecule("foo", nil)
+	if err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	_, err = atomfs.CreateMolecule("bar", nil)
+	if err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	err = atomfs.RenameMolecule("foo", "bar")
+	if err == nil {
+		t.Fatalf("renamed molecule on top of an existing one")
+	}
+
+	if !errors.Is(err, types.ErrMoleculeExists) {
+		t.Fatalf("renaming on top of an existing molecule didn't fail with ErrMoleculeExists: %s", err)
+	}
+
+	mols, err := atomfs.ListMolecules()
+	if err != nil {
+		t.Fatalf("couldn't list molecules %s", err)
+	}
+
+	if len(mols) != 2 || mols[0].Name != "foo" || mols[1].Name != "bar" {
+		t.Fatalf("bad molecules after failed rename: %v", mols)
+	}
+}
+
+func TestTransactionRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-tx-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	err = atomfs.WithTransaction(func(tx *Tx) error {
+		if _, err := tx.CreateMolecule("foo", nil); err != nil {
+			return err
+		}
+
+		return tx.RenameMolecule("doesnotexist", "bar")
+	})
+	if err == nil {
+		t.Fatalf("transaction succeeded renaming a molecule that doesn't exist")
+	}
+
+	mols, err := atomfs.ListMolecules()
+	if err != nil {
+		t.Fatalf("couldn't list molecules %s", err)
+	}
+
+	if len(mols) != 0 {
+		t.Fatalf("molecules left behind by rolled back transaction: %v", mols)
+	}
+}
+
+func TestDeleteMissingMolecule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-delete-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	err = atomfs.DeleteMolecule("doesnotexist")
+	if !errors.Is(err, types.ErrMoleculeNotFound) {
+		t.Fatalf("bad error deleting a molecule that doesn't exist: %v", err)
+	}
+}
+
+func TestSoftDeleteMolecule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-delete-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir, DeleteGracePeriod: time.Hour})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	atom, err := atomfs.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("foo", []types.Atom{atom}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if err := atomfs.DeleteMolecule("foo"); err != nil {
+		t.Fatalf("couldn't delete molecule %s", err)
+	}
+
+	if _, err := atomfs.GetMolecule("foo"); !errors.Is(err, types.ErrMoleculeNotFound) {
+		t.Fatalf("bad error getting a soft deleted molecule: %v", err)
+	}
+
+	report, err := atomfs.GCReport(false)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(report.PrunedAtoms) != 0 || len(report.PurgedMolecules) != 0 {
+		t.Fatalf("gc collected a molecule within its grace period: %v", report)
+	}
+
+	if err := atomfs.RestoreMolecule("foo"); err != nil {
+		t.Fatalf("couldn't restore molecule %s", err)
+	}
+
+	mol, err := atomfs.GetMolecule("foo")
+	if err != nil {
+		t.Fatalf("couldn't get restored molecule %s", err)
+	}
+
+	if len(mol.Atoms) != 1 || mol.Atoms[0].Hash != atom.Hash {
+		t.Fatalf("restored molecule has the wrong atoms: %v", mol.Atoms)
+	}
+}
@@ -1,23 +1,267 @@
 package atomfs
 
 import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
 	"github.com/anuvu/atomfs/mount"
+	"github.com/anuvu/atomfs/types"
+	"golang.org/x/sys/unix"
 )
 
+// Mount mounts each of the molecule's atoms, and then stacks them in an
+// overlay at target. If any of the molecule's atoms are missing, it fails
+// before mounting anything with an error wrapping ErrAtomMissing, and if
+// types.Config.VerifyOnRead is set, the same goes for ErrAtomCorrupt and any
+// atoms that don't match their hashes.
+//
+// Once the mount succeeds it is recorded in the db (unless the store is read
+// only), so that it shows up in ListMounts.
 func (atomfs *Instance) Mount(molecule string, target string, writable bool) error {
+	return atomfs.mount(molecule, target, func(mol types.Molecule) error {
+		ovl, err := mount.NewOverlay(atomfs.config, mol, writable)
+		if err != nil {
+			return err
+		}
+
+		return ovl.Mount(target, writable)
+	})
+}
+
+// MountRW is like a writable Mount, but keeps the changes made to the mount in
+// upperdir (using workdir as overlayfs' work directory), rather than in a
+// directory of atomfs' own. They are left there after Umount, so that they can
+// be captured as an atom with CaptureUpper or thrown away.
+func (atomfs *Instance) MountRW(molecule string, target string, upperdir string, workdir string) error {
+	return atomfs.mount(molecule, target, func(mol types.Molecule) error {
+		ovl, err := mount.NewOverlay(atomfs.config, mol, true)
+		if err != nil {
+			return err
+		}
+
+		return ovl.MountWithUpper(target, upperdir, workdir)
+	})
+}
+
+// CaptureUpper imports the changes in upperdir (e.g. one used by MountRW) as a
+// new tar atom. Files that were deleted in the mount are recorded as OCI
+// whiteouts, so the atom can be stacked on top of the mounted molecule's atoms
+// to reproduce it. The mount using upperdir should be unmounted first.
+func (atomfs *Instance) CaptureUpper(upperdir string) (types.Atom, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Atom{}, err
+	}
+	defer release()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeUpperTar(upperdir, w))
+	}()
+
+	atom, err := atomfs.ImportAtom(r)
+	// If the import failed part way through, unblock the writer.
+	r.Close()
+	return atom, err
+}
+
+// writeUpperTar writes the overlayfs upperdir dir to w as a tar archive,
+// converting overlayfs' whiteouts to OCI ones.
+func writeUpperTar(dir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		if isWhiteoutDevice(info) {
+			name := filepath.Join(filepath.Dir(rel), whiteoutPrefix+filepath.Base(rel))
+			return writeEmptyTarFile(tw, name, info)
+		}
+
+		if err := writeTarEntry(tw, p, rel, info); err != nil {
+			return err
+		}
+
+		if info.IsDir() && isOpaqueDir(p) {
+			return writeEmptyTarFile(tw, filepath.Join(rel, opaqueWhiteout), info)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+func writeEmptyTarFile(tw *tar.Writer, name string, info os.FileInfo) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(name),
+		Mode:     0644,
+		ModTime:  info.ModTime(),
+	})
+}
+
+// isOpaqueDir reports whether overlayfs has marked the directory at p opaque,
+// i.e. it hides the contents of the same directory in lower layers.
+func isOpaqueDir(p string) bool {
+	for _, attr := range []string{"trusted.overlay.opaque", "user.overlay.opaque"} {
+		buf := make([]byte, 1)
+		n, err := unix.Getxattr(p, attr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mount checks that the molecule can be mounted, calls do to mount it at
+// target, and then records the mount.
+func (atomfs *Instance) mount(molecule string, target string, do func(mol types.Molecule) error) error {
+	// GC mustn't remove any reassembled chunked atoms before they're
+	// mounted.
+	unlock, err := atomfs.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	mol, err := atomfs.db.GetMolecule(molecule)
 	if err != nil {
 		return err
 	}
 
-	ovl, err := mount.NewOverlay(atomfs.config, mol, writable)
+	_, missing, err := atomfs.PreviewMolecule(atomHashes(mol.Atoms))
 	if err != nil {
 		return err
 	}
 
-	return ovl.Mount(target, writable)
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: can't mount %s, missing %v", ErrAtomMissing, molecule, missing)
+	}
+
+	if err := checkNotEncrypted(molecule, mol.Atoms); err != nil {
+		return err
+	}
+
+	if err := atomfs.reassembleAtoms(mol.Atoms); err != nil {
+		return err
+	}
+
+	if atomfs.config.VerifyOnRead {
+		if err := atomfs.verifyMountedAtoms(mol.Atoms); err != nil {
+			return err
+		}
+	}
+
+	if err := do(mol); err != nil {
+		return err
+	}
+
+	if atomfs.config.ReadOnly {
+		return nil
+	}
+
+	if err := atomfs.db.TouchAtoms(mol.Atoms); err != nil {
+		return err
+	}
+
+	return atomfs.db.AddMount(target, mol.ID)
+}
+
+// verifyMountedAtoms checks the files that atoms are about to be mounted from
+// against their hashes, failing with an error wrapping ErrAtomMissing or
+// ErrAtomCorrupt for the first one that doesn't match.
+func (atomfs *Instance) verifyMountedAtoms(atoms []types.Atom) error {
+	seen := map[int64]bool{}
+	for _, atom := range atoms {
+		if seen[atom.ID] {
+			continue
+		}
+		seen[atom.ID] = true
+
+		// Chunked atoms are mounted from their reassembled files, which
+		// is what needs checking, not their chunks.
+		atom.Chunked = false
+		if err := fsckResultError(atomfs.checkAtom(context.Background(), atom)); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// Umount tears down the overlay at target and any of its atoms that aren't
+// used by another mount. The mount's record is removed from the db once the
+// overlay is gone, even if some of its atoms couldn't be cleaned up.
 func (atomfs *Instance) Umount(target string) error {
-	return mount.Umount(atomfs.config, target)
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = mount.Umount(atomfs.config, target)
+
+	if !atomfs.config.ReadOnly {
+		mounted, mErr := isMounted(target)
+		if mErr != nil {
+			return mErr
+		}
+
+		if !mounted {
+			if rErr := atomfs.db.RemoveMount(target); rErr != nil && err == nil {
+				err = rErr
+			}
+		}
+	}
+
+	return err
+}
+
+// ListMounts returns all of the mounts that atomfs has recorded. If atomfs
+// crashed, or something was unmounted behind its back, these may be stale;
+// compare them against /proc/self/mountinfo to find out.
+func (atomfs *Instance) ListMounts() ([]types.Mount, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return atomfs.db.GetMounts()
+}
+
+// isMounted reports whether there is an overlay mounted at target.
+func isMounted(target string) (bool, error) {
+	mounts, err := mount.ParseMounts()
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range mounts {
+		if m.Target == target && m.FSType == "overlay" {
+			return true, nil
+		}
+	}
+
+	return false, nil
 }
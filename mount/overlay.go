@@ -8,6 +8,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/anuvu/atomfs/storage"
 	"github.com/anuvu/atomfs/types"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
@@ -24,6 +25,45 @@ func NewOverlay(config types.Config, mol types.Molecule, writable bool) (*Overla
 }
 
 func (o *Overlay) Mount(dest string, writable bool) error {
+	if !writable {
+		return o.mount(dest, "")
+	}
+
+	// In order to make it so that we can Unmount() without saving any
+	// state, we construct special names for the workdir and upperdir:
+	//   sha256(dest)/{upperdir|workdir}
+	// Note that if this already exists, we don't want to re-use it (and
+	// indeed we can't, overlay will fail the mount); this means that there
+	// can only ever be one atomfs mount at a particular location. That
+	// doesn't seem too big a deal, though.
+	upperDir := o.config.OverlayDirsPath(sha256string(dest), "upperdir")
+	workDir := o.config.OverlayDirsPath(sha256string(dest), "workdir")
+
+	_, err := os.Stat(workDir)
+	if err == nil {
+		return errors.Errorf("%s is already an atomfs mountpoint", dest)
+	}
+
+	return o.MountWithUpper(dest, upperDir, workDir)
+}
+
+// MountWithUpper is like a writable Mount, but uses the given upperdir and
+// workdir for the overlay, which are created if they don't exist. Unlike the
+// ones Mount makes, they aren't removed by Umount.
+func (o *Overlay) MountWithUpper(dest string, upperDir string, workDir string) error {
+	if err := os.MkdirAll(upperDir, 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return err
+	}
+
+	return o.mount(dest, fmt.Sprintf(",upperdir=%s,workdir=%s", upperDir, workDir))
+}
+
+// mount mounts the atoms, and then the overlay of them at dest, with extraOpts
+// appended to its mount options.
+func (o *Overlay) mount(dest string, extraOpts string) error {
 	// The kernel unfortunately doesn't support mntopts > 4096 characters,
 	// so let's figure out if we've got too many atoms here:
 	//     len("lowerdir=") + len(o.atoms) * (len(config.Path) + len("/atoms/") + 64 + 1)
@@ -35,6 +75,12 @@ func (o *Overlay) Mount(dest string, writable bool) error {
 		return fmt.Errorf("too many lower dirs; must have fewer than 4096 chars")
 	}
 
+	// The kernel (and archivemount) need the atoms to be actual files.
+	local, ok := o.config.AtomStorage().(*storage.Local)
+	if !ok {
+		return errors.Errorf("atoms can only be mounted from local storage")
+	}
+
 	dirs := []string{}
 	// first, mount everything
 	for _, a := range o.mol.Atoms {
@@ -58,7 +104,7 @@ func (o *Overlay) Mount(dest string, writable bool) error {
 			return errors.Errorf("don't know how to mount %s of type %s", a.Name, a.Type)
 		}
 
-		if err := mounter(o.config.AtomsPath(a.Hash), target); err != nil {
+		if err := mounter(local.Path(a.FileName()), target); err != nil {
 			return errors.Wrapf(err, "couldn't mount")
 		}
 	}
@@ -77,33 +123,7 @@ func (o *Overlay) Mount(dest string, writable bool) error {
 
 	// Note that in overlayfs, the first thing is the top most layer in the
 	// overlay.
-	mntOpts := "lowerdir=" + strings.Join(dirs, ":")
-	if writable {
-		// In order to make it so that we can Unmount() without saving
-		// any state, we construct special names for the workdir and
-		// upperdir:
-		//   sha256(dest)/{upperdir|workdir}
-		// Note that if this already exists, we don't want to re-use it
-		// (and indeed we can't, overlay will fail the mount); this
-		// means that there can only ever be one atomfs mount at a
-		// particular location. That doesn't seem too big a deal, though.
-		upperDir := o.config.OverlayDirsPath(sha256string(dest), "upperdir")
-		workDir := o.config.OverlayDirsPath(sha256string(dest), "workdir")
-
-		_, err := os.Stat(workDir)
-		if err == nil {
-			return errors.Errorf("%s is already an atomfs mountpoint", dest)
-		}
-
-		if err := os.MkdirAll(upperDir, 0755); err != nil {
-			return err
-		}
-		if err := os.MkdirAll(workDir, 0755); err != nil {
-			return err
-		}
-
-		mntOpts += fmt.Sprintf(",upperdir=%s,workdir=%s", upperDir, workDir)
-	}
+	mntOpts := "lowerdir=" + strings.Join(dirs, ":") + extraOpts
 
 	// now, do the actual overlay mount
 	err := unix.Mount("overlay", dest, "overlay", 0, mntOpts)
@@ -145,21 +165,61 @@ func Umount(config types.Config, dest string) error {
 		return err
 	}
 
+	failures := []string{}
+
 	// If this was writable, we should clean up the work/upperdir.
 	err = os.RemoveAll(config.OverlayDirsPath(sha256string(dest)))
 	if err != nil && !os.IsNotExist(err) {
+		failures = append(failures, fmt.Sprintf("%s: %v", dest, err))
+	}
+
+	atomFailures, err := umountUnusedAtoms(underlyingAtoms)
+	if err != nil {
 		return err
 	}
+	failures = append(failures, atomFailures...)
 
-	// now, "refcount" the remaining atoms and see if any of ours are
-	// unused
-	usedAtoms := map[string]bool{}
+	if len(failures) > 0 {
+		return errors.Errorf("couldn't clean up %s: %s", dest, strings.Join(failures, "; "))
+	}
 
-	mounts, err = ParseMounts()
+	return nil
+}
+
+// UmountAtoms unmounts the mountpoints of any of atoms that aren't used by an
+// overlay, e.g. to clean up after mounting an overlay of them failed part way
+// through.
+func UmountAtoms(config types.Config, atoms []types.Atom) error {
+	dirs := []string{}
+	for _, a := range atoms {
+		dirs = append(dirs, config.MountedAtomsPath(a.Hash))
+	}
+
+	failures, err := umountUnusedAtoms(dirs)
 	if err != nil {
 		return err
 	}
 
+	if len(failures) > 0 {
+		return errors.Errorf("couldn't clean up atoms: %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+// umountUnusedAtoms unmounts and removes any of the atom mountpoints in
+// atomDirs that no overlay uses, returning a description of each one that
+// couldn't be cleaned up.
+func umountUnusedAtoms(atomDirs []string) ([]string, error) {
+	// "refcount" the atoms that are still mounted, to see if any of ours
+	// are unused
+	usedAtoms := map[string]bool{}
+
+	mounts, err := ParseMounts()
+	if err != nil {
+		return nil, err
+	}
+
 	for _, m := range mounts {
 		if m.FSType != "overlay" {
 			continue
@@ -171,9 +231,11 @@ func Umount(config types.Config, dest string) error {
 		}
 	}
 
-	// If any of the atoms underlying the target mountpoint are now unused,
-	// let's unmount them too.
-	for _, a := range underlyingAtoms {
+	// If any of our atoms are unused, unmount them. We keep going if one
+	// of them fails, so that one busy atom doesn't leak the rest of them
+	// (and their loop devices).
+	failures := []string{}
+	for _, a := range atomDirs {
 		_, used := usedAtoms[a]
 		if used {
 			continue
@@ -184,12 +246,22 @@ func Umount(config types.Config, dest string) error {
 			continue
 		}
 
-		if err := unix.Unmount(a, 0); err != nil {
-			return err
+		// EINVAL means it's not mounted and ENOENT means it's not there
+		// at all; either way, somebody already cleaned it up.
+		err := unix.Unmount(a, 0)
+		if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+			failures = append(failures, fmt.Sprintf("%s: %v", a, err))
+			continue
+		}
+
+		// Mount() assumes that an atom is mounted if its mountpoint
+		// exists, so get rid of it.
+		if err := os.Remove(a); err != nil && !os.IsNotExist(err) {
+			failures = append(failures, fmt.Sprintf("%s: %v", a, err))
 		}
 	}
 
-	return nil
+	return failures, nil
 }
 
 type Mount struct {
@@ -0,0 +1,66 @@
+package atomfs
+
+// PinAtom protects the atom with the given hash from GC: while it is pinned,
+// it is never pruned, even if no molecule uses it. GCReport.PinnedAtoms lists
+// the pinned atoms that would otherwise have been pruned.
+func (atomfs *Instance) PinAtom(hash string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.db.SetAtomPinned(hash, true)
+}
+
+// UnpinAtom undoes PinAtom, so that the atom is pruned by the next GC if
+// nothing uses it.
+func (atomfs *Instance) UnpinAtom(hash string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.db.SetAtomPinned(hash, false)
+}
+
+// PinMolecule protects the molecule called name from being collected, i.e.
+// by GCOptions.EmptyMolecules or PruneMoleculesOlderThan. Its atoms are used
+// by it, so they aren't pruned either. It can still be deleted explicitly.
+func (atomfs *Instance) PinMolecule(name string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.db.SetMoleculePinned(name, true)
+}
+
+// UnpinMolecule undoes PinMolecule.
+func (atomfs *Instance) UnpinMolecule(name string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.db.SetMoleculePinned(name, false)
+}
@@ -0,0 +1,58 @@
+package atomfs
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestPinnedAtomSurvivesGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-pins-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	atom, err := atomfs.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	if err := atomfs.PinAtom(atom.Hash); err != nil {
+		t.Fatalf("couldn't pin atom %s", err)
+	}
+
+	report, err := atomfs.GCReport(false)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(report.PrunedAtoms) != 0 || len(report.PinnedAtoms) != 1 {
+		t.Fatalf("gc didn't skip the pinned atom: %v", report)
+	}
+
+	if ok, err := atomfs.HasAtom(atom.Hash); err != nil || !ok {
+		t.Fatalf("pinned atom is gone after gc: %v", err)
+	}
+
+	if err := atomfs.UnpinAtom(atom.Hash); err != nil {
+		t.Fatalf("couldn't unpin atom %s", err)
+	}
+
+	report, err = atomfs.GCReport(false)
+	if err != nil {
+		t.Fatalf("couldn't gc %s", err)
+	}
+
+	if len(report.PrunedAtoms) != 1 || report.PrunedAtoms[0].Hash != atom.Hash {
+		t.Fatalf("expected the unpinned atom to be pruned, got %v", report.PrunedAtoms)
+	}
+}
@@ -0,0 +1,81 @@
+package atomfs
+
+import (
+	"context"
+	"io"
+
+	"github.com/anuvu/atomfs/types"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/image"
+	"github.com/containers/image/pkg/blobinfocache"
+	imagetypes "github.com/containers/image/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Docker's media types for layers, which registries still serve for most
+// images.
+const (
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// PullImage pulls the image ref (e.g. "docker.io/library/alpine:3.9") from its
+// registry and imports it as a molecule called moleculeName. Credentials are
+// found the same way as other containers/image based tools find them (e.g.
+// in ~/.docker/config.json), and manifest lists are resolved to the image
+// for the current platform. Layers that are already atoms aren't downloaded
+// again; new ones are checked against their digests as they are imported.
+func (atomfs *Instance) PullImage(ref string, moleculeName string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	ctx := context.Background()
+
+	imgRef, err := docker.ParseReference("//" + ref)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	src, err := imgRef.NewImageSource(ctx, nil)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	// img takes over src, and closes it when it's closed.
+	img, err := image.FromSource(ctx, nil, src)
+	if err != nil {
+		src.Close()
+		return types.Molecule{}, err
+	}
+	defer img.Close()
+
+	layers := img.LayerInfos()
+	descs := make([]ispec.Descriptor, len(layers))
+	for i, layer := range layers {
+		descs[i] = ispec.Descriptor{
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		}
+	}
+
+	fetch := func(desc ispec.Descriptor) (io.ReadCloser, error) {
+		info := imagetypes.BlobInfo{Digest: desc.Digest, Size: desc.Size, MediaType: desc.MediaType}
+		r, _, err := src.GetBlob(ctx, info, blobinfocache.NoCache)
+		return r, err
+	}
+
+	atoms, err := atomfs.importOCILayers(fetch, descs)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	return atomfs.createMoleculeFromLayers(moleculeName, atoms)
+}
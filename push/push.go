@@ -0,0 +1,63 @@
+// Package push pushes atomfs molecules to registries. It is separate from
+// package atomfs because containers/image's image copying needs gpgme (unless
+// it is built with the containers_image_openpgp tag), which users of atomfs
+// that never push shouldn't have to link against.
+package push
+
+import (
+	"context"
+	"os"
+
+	"github.com/anuvu/atomfs"
+	"github.com/containers/image/copy"
+	"github.com/containers/image/docker"
+	"github.com/containers/image/oci/layout"
+	"github.com/containers/image/signature"
+)
+
+// layoutTag is what the image is tagged in the scratch layout. Molecule names
+// may not be valid tags, so they aren't used.
+const layoutTag = "push"
+
+// Molecule pushes the molecule called name to a registry as the image ref
+// (e.g. "registry.example.com/foo:latest"), with each of its atoms as a layer.
+// Credentials are found the same way as for atomfs.Instance.PullImage. Blobs
+// that the registry already has aren't uploaded again.
+//
+// The image is built by exporting the molecule to a scratch OCI layout in the
+// store's directory (see atomfs.Instance.TempDir), which links rather than
+// copies the atoms where it can, so this doesn't need much extra space.
+func Molecule(fs *atomfs.Instance, name string, ref string) error {
+	ctx := context.Background()
+
+	destRef, err := docker.ParseReference("//" + ref)
+	if err != nil {
+		return err
+	}
+
+	dir, err := fs.TempDir(".push-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := fs.ExportOCIAs(name, dir, layoutTag); err != nil {
+		return err
+	}
+
+	srcRef, err := layout.NewReference(dir, layoutTag)
+	if err != nil {
+		return err
+	}
+
+	// We built the image ourselves, so there are no signatures to check.
+	policy := &signature.Policy{Default: []signature.PolicyRequirement{signature.NewPRInsecureAcceptAnything()}}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	_, err = copy.Image(ctx, policyContext, destRef, srcRef, &copy.Options{})
+	return err
+}
@@ -0,0 +1,32 @@
+package atomfs
+
+import (
+	"github.com/anuvu/atomfs/types"
+)
+
+// ErrStoreFull is returned (wrapped) when importing an atom would take the
+// store past types.Config.MaxAtoms or MaxBytes. It is the same error as
+// types.ErrStoreFull.
+var ErrStoreFull = types.ErrStoreFull
+
+// CheckQuota returns how much of the store's limits (types.Config.MaxAtoms and
+// MaxBytes) are used, as the AtomCount and TotalBytesOnDisk of used and
+// limit; the other fields are zero. The usage is worked out from the sizes
+// recorded in the db rather than the atoms' files, so it is cheap, and a limit
+// of zero means there isn't one.
+func (atomfs *Instance) CheckQuota() (used, limit Stats, err error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return Stats{}, Stats{}, err
+	}
+	defer release()
+
+	count, size, err := atomfs.db.AtomUsage()
+	if err != nil {
+		return Stats{}, Stats{}, err
+	}
+
+	used = Stats{AtomCount: count, TotalBytesOnDisk: size}
+	limit = Stats{AtomCount: atomfs.config.MaxAtoms, TotalBytesOnDisk: atomfs.config.MaxBytes}
+	return used, limit, nil
+}
@@ -0,0 +1,52 @@
+package atomfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestStoreFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-quota-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir, MaxAtoms: 1})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	if _, err := atomfs.ImportAtom(strings.NewReader("foo")); err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	_, err = atomfs.ImportAtom(strings.NewReader("bar"))
+	if !errors.Is(err, types.ErrStoreFull) {
+		t.Fatalf("bad error importing into a full store: %v", err)
+	}
+
+	// The rejected atom shouldn't have left anything behind.
+	files, err := atomfs.storage.List()
+	if err != nil {
+		t.Fatalf("couldn't list atoms %s", err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected one file in the atoms dir, got %v", files)
+	}
+
+	used, limit, err := atomfs.CheckQuota()
+	if err != nil {
+		t.Fatalf("couldn't check quota %s", err)
+	}
+
+	if used.AtomCount != 1 || limit.AtomCount != 1 {
+		t.Fatalf("bad quota usage %v of %v", used, limit)
+	}
+}
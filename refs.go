@@ -0,0 +1,95 @@
+package atomfs
+
+import (
+	"sync"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// ErrClosed is returned by operations on an Instance that has been closed. It
+// is the same error as types.ErrClosed.
+var ErrClosed = types.ErrClosed
+
+// refs counts the holders of an Instance (see Open and Close) and the
+// operations that are running on it, so that the db isn't closed underneath
+// them.
+type refs struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// holders is how many times the Instance has been opened (New counts
+	// as one) and not yet closed.
+	holders int
+	// inFlight is how many operations are running.
+	inFlight int
+	closed   bool
+}
+
+func newRefs() *refs {
+	r := &refs{holders: 1}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Open adds a holder to the Instance, which must be matched by a call to
+// Close. The Instance is only really closed when its last holder closes it,
+// so code that shares an Instance (e.g. request handlers in a server) can
+// each Open and Close it without worrying about the others.
+func (atomfs *Instance) Open() error {
+	atomfs.refs.mu.Lock()
+	defer atomfs.refs.mu.Unlock()
+
+	if atomfs.refs.closed {
+		return ErrClosed
+	}
+
+	atomfs.refs.holders++
+	return nil
+}
+
+// Close drops a holder of the Instance. When the last holder closes it, any
+// operations still running are waited for, the db is closed, and all further
+// operations fail with ErrClosed.
+func (atomfs *Instance) Close() error {
+	r := atomfs.refs
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+
+	r.holders--
+	if r.holders > 0 {
+		return nil
+	}
+
+	r.closed = true
+	for r.inFlight > 0 {
+		r.cond.Wait()
+	}
+
+	return atomfs.db.Close()
+}
+
+// acquire marks the start of an operation, returning a function that marks its
+// end, or ErrClosed if the Instance has been closed.
+func (atomfs *Instance) acquire() (func(), error) {
+	r := atomfs.refs
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, ErrClosed
+	}
+
+	r.inFlight++
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.inFlight--
+		if r.inFlight == 0 {
+			r.cond.Broadcast()
+		}
+	}, nil
+}
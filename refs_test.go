@@ -0,0 +1,54 @@
+package atomfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-refs-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: dir})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	// A second holder keeps the instance open after the first closes it.
+	if err := atomfs.Open(); err != nil {
+		t.Fatalf("couldn't open a second holder %s", err)
+	}
+
+	if err := atomfs.Close(); err != nil {
+		t.Fatalf("couldn't close atomfs %s", err)
+	}
+
+	atom, err := atomfs.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom with a holder left %s", err)
+	}
+
+	if err := atomfs.Close(); err != nil {
+		t.Fatalf("couldn't close atomfs %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("foo", []types.Atom{atom}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("bad error creating a molecule after close: %v", err)
+	}
+
+	if _, err := atomfs.GetAtoms(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("bad error listing atoms after close: %v", err)
+	}
+
+	if err := atomfs.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("bad error closing twice: %v", err)
+	}
+}
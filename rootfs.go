@@ -0,0 +1,105 @@
+package atomfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anuvu/atomfs/mount"
+	"github.com/anuvu/atomfs/types"
+)
+
+// Rootfs is a molecule assembled by PrepareRootfs into a writable root
+// filesystem for a container.
+type Rootfs struct {
+	// Path is the overlay of the molecule's atoms, e.g. to pivot_root
+	// into.
+	Path string
+	// Upper is the overlay's upperdir, which holds the changes made in
+	// Path. See CaptureUpper.
+	Upper string
+	// Work is the overlay's workdir.
+	Work string
+
+	atomfs *Instance
+	atoms  []types.Atom
+}
+
+// PrepareRootfs mounts a writable overlay of the molecule at dir/rootfs, with
+// its upperdir and workdir in dir/upper and dir/work, as in MountRW. It
+// doesn't set up a mount namespace; a container runtime would typically call
+// it from the container's own namespace before pivot_root.
+//
+// If it fails, it cleans up whatever it had mounted itself, and returns the
+// zero Rootfs.
+func (atomfs *Instance) PrepareRootfs(molecule string, dir string) (Rootfs, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return Rootfs{}, err
+	}
+	defer release()
+
+	rootfs := Rootfs{
+		Path:   filepath.Join(dir, "rootfs"),
+		Upper:  filepath.Join(dir, "upper"),
+		Work:   filepath.Join(dir, "work"),
+		atomfs: atomfs,
+	}
+
+	if err := os.MkdirAll(rootfs.Path, 0755); err != nil {
+		return Rootfs{}, err
+	}
+
+	err = atomfs.mount(molecule, rootfs.Path, func(mol types.Molecule) error {
+		ovl, err := mount.NewOverlay(atomfs.config, mol, true)
+		if err != nil {
+			return err
+		}
+
+		// Remember the atoms before mounting any of them, so that
+		// Cleanup can find them if the overlay never gets mounted.
+		rootfs.atoms = mol.Atoms
+		return ovl.MountWithUpper(rootfs.Path, rootfs.Upper, rootfs.Work)
+	})
+	if err != nil {
+		if cErr := rootfs.Cleanup(); cErr != nil {
+			return Rootfs{}, fmt.Errorf("%w (and couldn't clean up: %v)", err, cErr)
+		}
+		return Rootfs{}, err
+	}
+
+	return rootfs, nil
+}
+
+// Cleanup unmounts the rootfs and any of its atoms that nothing else uses,
+// however far PrepareRootfs got, and removes Path and Work. Upper is left
+// alone, so that its changes can still be captured; remove it to throw them
+// away. Calling Cleanup again (e.g. after it failed) is harmless.
+func (r Rootfs) Cleanup() error {
+	mounted, err := isMounted(r.Path)
+	if err != nil {
+		return err
+	}
+
+	if mounted {
+		// Umount also cleans up the atoms.
+		if err := r.atomfs.Umount(r.Path); err != nil {
+			return err
+		}
+	} else if len(r.atoms) > 0 {
+		if err := mount.UmountAtoms(r.atomfs.config, r.atoms); err != nil {
+			return err
+		}
+	}
+
+	if err := os.RemoveAll(r.Work); err != nil {
+		return err
+	}
+
+	if err := os.Remove(r.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package atomfs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+func TestPrepareRootfsFailureCleansUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-rootfs-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	atomfs, err := New(types.Config{Path: path.Join(dir, "store")})
+	if err != nil {
+		t.Fatalf("couldn't open atomfs %s", err)
+	}
+
+	atom, err := atomfs.ImportAtom(strings.NewReader("foo"))
+	if err != nil {
+		t.Fatalf("couldn't import atom %s", err)
+	}
+
+	if _, err := atomfs.CreateMolecule("broken", []types.Atom{atom}); err != nil {
+		t.Fatalf("couldn't create molecule %s", err)
+	}
+
+	if err := atomfs.storage.Remove(atom.FileName()); err != nil {
+		t.Fatalf("couldn't remove atom %s", err)
+	}
+
+	for molecule, expected := range map[string]error{
+		"missing": types.ErrMoleculeNotFound,
+		"broken":  ErrAtomMissing,
+	} {
+		container := path.Join(dir, molecule)
+		rootfs, err := atomfs.PrepareRootfs(molecule, container)
+		if !errors.Is(err, expected) {
+			t.Fatalf("bad error preparing %s: %v", molecule, err)
+		}
+
+		if rootfs.Path != "" || rootfs.atomfs != nil || rootfs.atoms != nil {
+			t.Fatalf("failed PrepareRootfs returned %v", rootfs)
+		}
+
+		for _, name := range []string{"rootfs", "work"} {
+			if _, err := os.Stat(path.Join(container, name)); !os.IsNotExist(err) {
+				t.Fatalf("failed PrepareRootfs of %s left %s behind: %v", molecule, name, err)
+			}
+		}
+	}
+}
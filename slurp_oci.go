@@ -3,10 +3,66 @@ package atomfs
 import (
 	"context"
 
+	"github.com/anuvu/atomfs/types"
 	"github.com/openSUSE/umoci"
+	"github.com/pkg/errors"
 )
 
+// ImportOCI imports an image from the OCI layout at dir as a molecule called
+// moleculeName. The image tagged moleculeName is used if there is one;
+// otherwise the layout must contain exactly one image. Layers that are
+// already in atomfs are reused rather than copied again.
+func (atomfs *Instance) ImportOCI(dir string, moleculeName string) (types.Molecule, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return types.Molecule{}, err
+	}
+
+	oci, err := umoci.OpenLayout(dir)
+	if err != nil {
+		return types.Molecule{}, err
+	}
+	defer oci.Close()
+
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return types.Molecule{}, err
+	}
+
+	tag := ""
+	for _, t := range tags {
+		if t == moleculeName {
+			tag = t
+			break
+		}
+	}
+
+	if tag == "" {
+		if len(tags) != 1 {
+			return types.Molecule{}, errors.Errorf("%s has %d images and none are tagged %s", dir, len(tags), moleculeName)
+		}
+		tag = tags[0]
+	}
+
+	return atomfs.createMoleculeFromOCITag(oci, tag, moleculeName)
+}
+
 func (atomfs *Instance) SlurpOCI(location string) error {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
 	oci, err := umoci.OpenLayout(location)
 	if err != nil {
 		return err
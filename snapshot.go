@@ -0,0 +1,60 @@
+package atomfs
+
+// Snapshot is a read only view of the store as its db was when OpenSnapshot
+// was called. Everything that only reads the db (e.g. ListMolecules, or the
+// db side of FSCK) gives answers that are consistent with each other, even if
+// other processes change the store in the meantime. Only the db is frozen,
+// not the atoms' files, so e.g. FSCK can still find atoms that were deleted
+// since to be missing. Operations that would change the store fail with
+// ErrReadOnly.
+type Snapshot struct {
+	*Instance
+	release func()
+}
+
+// OpenSnapshot starts a Snapshot of the store, which must be released with
+// Release. The Instance isn't closed until all of its snapshots are released.
+func (atomfs *Instance) OpenSnapshot() (*Snapshot, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	dbSnap, err := atomfs.db.Snapshot()
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	config := atomfs.config
+	config.ReadOnly = true
+	inst := &Instance{
+		config:   config,
+		db:       dbSnap,
+		storage:  atomfs.storage,
+		verifier: atomfs.verifier,
+		metrics:  atomfs.metrics,
+		refs:     atomfs.refs,
+	}
+
+	return &Snapshot{inst, release}, nil
+}
+
+// Release ends the snapshot. It must not be used afterwards; releasing it
+// again fails with ErrClosed.
+func (s *Snapshot) Release() error {
+	if s.release == nil {
+		return ErrClosed
+	}
+
+	err := s.db.Release()
+	s.release()
+	s.release = nil
+	return err
+}
+
+// Close is Release, so that closing a Snapshot like an Instance doesn't close
+// the Instance that it is a snapshot of.
+func (s *Snapshot) Close() error {
+	return s.Release()
+}
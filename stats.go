@@ -0,0 +1,52 @@
+package atomfs
+
+import (
+	"github.com/anuvu/atomfs/storage"
+)
+
+// Stats are some basic metrics about an atomfs store.
+type Stats struct {
+	AtomCount        int
+	MoleculeCount    int
+	UnusedAtomCount  int
+	TotalBytesOnDisk int64
+}
+
+// Stats computes some metrics about this atomfs store. It doesn't read any
+// atom contents, so it is cheap enough to call often. Atom files that are hard
+// links to one another only count once towards TotalBytesOnDisk.
+func (atomfs *Instance) Stats() (Stats, error) {
+	release, err := atomfs.acquire()
+	if err != nil {
+		return Stats{}, err
+	}
+	defer release()
+
+	stats := Stats{}
+
+	atoms, err := atomfs.db.GetAtoms()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.AtomCount = len(atoms)
+
+	unused, err := atomfs.db.GetUnusedAtoms()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.UnusedAtomCount = len(unused)
+
+	stats.MoleculeCount, err = atomfs.db.CountMolecules()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	files, err := atomfs.storage.List()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	stats.TotalBytesOnDisk = storage.UniqueBytes(files)
+
+	return stats, nil
+}
@@ -0,0 +1,391 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Local keeps objects as files in a directory on the local filesystem.
+type Local struct {
+	root string
+	// levels is how many levels of shard directories objects are kept
+	// in; see NewShardedLocal.
+	levels int
+}
+
+// NewLocal returns a Local that keeps objects in the directory root.
+func NewLocal(root string) *Local {
+	return &Local{root, 0}
+}
+
+// MaxShardLevels is the most levels of shard directories a Local can have;
+// more than this would only make lookups slower.
+const MaxShardLevels = 4
+
+// NewShardedLocal is like NewLocal, but keeps objects in levels of
+// subdirectories named after successive pairs of characters of their base
+// name, so that no one directory gets too big. For example, with two levels,
+// "abcdef" is kept in ab/cd/abcdef. Objects that were written with a different
+// number of levels are still found at their old locations (see Reshard).
+func NewShardedLocal(root string, levels int) *Local {
+	return &Local{root, levels}
+}
+
+// CanonicalPath is the path that the object called name is written to.
+func (l *Local) CanonicalPath(name string) string {
+	return l.shardedPath(name, l.levels)
+}
+
+// shardedPath is the path of the object called name with levels levels of
+// shard directories.
+func (l *Local) shardedPath(name string, levels int) string {
+	dir, base := path.Split(name)
+	parts := []string{l.root, dir}
+	for i := 0; i < levels && 2*(i+1) < len(base); i++ {
+		parts = append(parts, base[2*i:2*(i+1)])
+	}
+
+	return path.Join(append(parts, base)...)
+}
+
+// Path is the path of the file for the object called name. This is usually
+// CanonicalPath(name), but objects written with any other number of shard
+// levels (up to MaxShardLevels) are still found where they were written, e.g.
+// before sharding was turned on, or after it was turned off.
+func (l *Local) Path(name string) string {
+	p := l.CanonicalPath(name)
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		return p
+	}
+
+	for levels := 0; levels <= MaxShardLevels; levels++ {
+		if levels == l.levels {
+			continue
+		}
+
+		other := l.shardedPath(name, levels)
+		if _, err := os.Lstat(other); err == nil {
+			return other
+		}
+	}
+
+	return p
+}
+
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.Path(name))
+}
+
+func (l *Local) Create() (Writer, error) {
+	f, err := ioutil.TempFile(l.root, TempPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{l, f}, nil
+}
+
+// Link is like Create, but the new object's content is the file at src. The
+// file is hardlinked if possible (so src must not be modified afterwards),
+// and copied otherwise (e.g. if it is on another filesystem). It also returns
+// the path of the linked (or copied) file, so that its content can be checked
+// before it is committed.
+func (l *Local) Link(src string) (Writer, string, error) {
+	f, err := ioutil.TempFile(l.root, TempPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Swap the temp file for a link to src, keeping its (unique) name.
+	f.Close()
+	os.Remove(f.Name())
+	if err := os.Link(src, f.Name()); err == nil {
+		return &linkedWriter{l, f.Name()}, f.Name(), nil
+	}
+
+	cf, err := ioutil.TempFile(l.root, TempPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	w := &localWriter{l, cf}
+
+	in, err := os.Open(src)
+	if err != nil {
+		w.Abort()
+		return nil, "", err
+	}
+	defer in.Close()
+
+	if _, err := io.Copy(w, in); err != nil {
+		w.Abort()
+		return nil, "", err
+	}
+
+	return w, cf.Name(), nil
+}
+
+func (l *Local) Remove(name string) error {
+	return os.Remove(l.Path(name))
+}
+
+// List lists the files under the root directory, with any shard directories
+// stripped out of their names. It's possible that nothing has been written
+// yet, in which case the root directory may not exist; that's not an error.
+func (l *Local) List() ([]FileInfo, error) {
+	files := []FileInfo{}
+	err := l.walk(func(p string, name string, fi os.FileInfo) error {
+		files = append(files, localFileInfo(name, fi))
+		return nil
+	})
+	return files, err
+}
+
+// Reshard moves any objects that aren't at their CanonicalPath there, e.g.
+// after the number of shard levels has changed. Empty shard directories are
+// left behind.
+func (l *Local) Reshard() error {
+	_, err := l.reshard(false)
+	return err
+}
+
+// reshard is Reshard, returning the names of the objects it moved. If dryRun
+// is true, nothing is moved, but the objects that would have been are still
+// returned.
+func (l *Local) reshard(dryRun bool) ([]string, error) {
+	moved := []string{}
+	err := l.walk(func(p string, name string, fi os.FileInfo) error {
+		dest := l.CanonicalPath(name)
+		if p == dest || strings.HasPrefix(path.Base(name), TempPrefix) {
+			return nil
+		}
+
+		moved = append(moved, name)
+		if dryRun {
+			return nil
+		}
+
+		if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+			return err
+		}
+
+		return os.Rename(p, dest)
+	})
+	return moved, err
+}
+
+// Defrag is like Reshard, but also removes any directories that are left
+// empty, and returns the names of the objects it moved. If dryRun is true,
+// nothing is changed, but the objects that would have been moved are still
+// returned. Objects are moved with rename(), so if it is interrupted, each
+// one is at either its old path or its new one.
+func (l *Local) Defrag(dryRun bool) ([]string, error) {
+	moved, err := l.reshard(dryRun)
+	if err != nil || dryRun {
+		return moved, err
+	}
+
+	return moved, l.removeEmptyDirs()
+}
+
+// removeEmptyDirs removes the directories under the root directory that have
+// nothing in them (other than more empty directories).
+func (l *Local) removeEmptyDirs() error {
+	dirs := []string{}
+	err := filepath.Walk(l.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && p != l.root {
+			dirs = append(dirs, p)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Walk visits parents before their children, so go backwards to
+	// empty the children first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := ioutil.ReadDir(dirs[i])
+		if err != nil {
+			return err
+		}
+
+		if len(entries) > 0 {
+			continue
+		}
+
+		if err := os.Remove(dirs[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walk calls f with the path and object name of every file under the root
+// directory.
+func (l *Local) walk(f func(p string, name string, fi os.FileInfo) error) error {
+	if _, err := os.Stat(l.root); os.IsNotExist(err) {
+		return nil
+	}
+
+	return filepath.Walk(l.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+
+		return f(p, objectName(filepath.ToSlash(rel)), fi)
+	})
+}
+
+// objectName is the name of the object kept at rel (relative to the root
+// directory), i.e. rel without any shard directories. Those are always two
+// characters long, so they can't be confused with the directories that
+// objects' names can have (e.g. "sha512").
+func objectName(rel string) string {
+	parts := strings.Split(rel, "/")
+	if len(parts) == 1 {
+		return rel
+	}
+
+	base := parts[len(parts)-1]
+	if len(parts[0]) != 2 {
+		return path.Join(parts[0], base)
+	}
+
+	return base
+}
+
+func (l *Local) Stat(name string) (FileInfo, error) {
+	fi, err := os.Stat(l.Path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	return localFileInfo(name, fi), nil
+}
+
+// localFileInfo describes the object called name, whose file is described by
+// fi.
+func localFileInfo(name string, fi os.FileInfo) FileInfo {
+	info := FileInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		info.Inode = uint64(st.Ino)
+		info.Links = uint64(st.Nlink)
+	}
+
+	return info
+}
+
+type localWriter struct {
+	l *Local
+	f *os.File
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *localWriter) Commit(name string) error {
+	// Make sure the content is on disk before it is visible under its
+	// real name, so that a crash can't leave a partial object there.
+	err := w.f.Sync()
+	if cErr := w.f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+
+	return w.l.commit(w.f.Name(), name)
+}
+
+func (w *localWriter) Abort() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+// linkedWriter is a Writer for an object whose content is already in place at
+// a temp name.
+type linkedWriter struct {
+	l    *Local
+	name string
+}
+
+func (w *linkedWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("can't write to a linked object")
+}
+
+func (w *linkedWriter) Commit(name string) error {
+	if err := SyncFile(w.name); err != nil {
+		os.Remove(w.name)
+		return err
+	}
+
+	return w.l.commit(w.name, name)
+}
+
+func (w *linkedWriter) Abort() error {
+	return os.Remove(w.name)
+}
+
+// commit renames the (already synced) temp file tmp into place as the object
+// called name. tmp may not be in the same directory as the object, but it is
+// on the same filesystem, so the rename is still atomic; the directories are
+// synced afterwards so that it is durable too.
+func (l *Local) commit(tmp string, name string) error {
+	dest := l.CanonicalPath(name)
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Sync every directory from the object's up to the root, which covers
+	// both ends of the rename and any shard directories we just made.
+	for dir := path.Dir(dest); ; dir = path.Dir(dir) {
+		if err := SyncFile(dir); err != nil {
+			return err
+		}
+
+		if dir == path.Clean(l.root) || dir == "/" || dir == "." {
+			return nil
+		}
+	}
+}
+
+// SyncFile fsyncs the file or directory at p.
+func SyncFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeObject(t *testing.T, l *Local, name string) {
+	w, err := l.Create()
+	if err != nil {
+		t.Fatalf("couldn't create object %s", err)
+	}
+
+	if _, err := w.Write([]byte(name)); err != nil {
+		t.Fatalf("couldn't write object %s", err)
+	}
+
+	if err := w.Commit(name); err != nil {
+		t.Fatalf("couldn't commit object %s", err)
+	}
+}
+
+func TestShardedPath(t *testing.T) {
+	l := NewShardedLocal("/atoms", 2)
+	if p := l.CanonicalPath("abcdef"); p != "/atoms/ab/cd/abcdef" {
+		t.Fatalf("bad sharded path %s", p)
+	}
+
+	if p := l.CanonicalPath("sha512/abcdef"); p != "/atoms/sha512/ab/cd/abcdef" {
+		t.Fatalf("bad sharded path %s", p)
+	}
+}
+
+func TestFindAnyShardLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomfs-storage-")
+	if err != nil {
+		t.Fatalf("couldn't make tempdir %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for levels := 0; levels <= MaxShardLevels; levels++ {
+		writeObject(t, NewShardedLocal(dir, levels), "0123456789abcdef"[levels:])
+	}
+
+	for levels := 0; levels <= MaxShardLevels; levels++ {
+		l := NewShardedLocal(dir, levels)
+		for written := 0; written <= MaxShardLevels; written++ {
+			name := "0123456789abcdef"[written:]
+			content, err := ioutil.ReadFile(l.Path(name))
+			if err != nil {
+				t.Fatalf("couldn't find object written with %d levels using %d: %s", written, levels, err)
+			}
+
+			if string(content) != name {
+				t.Fatalf("found the wrong object for %s: %s", name, content)
+			}
+		}
+	}
+
+	l := NewShardedLocal(dir, 1)
+	if _, err := l.Defrag(false); err != nil {
+		t.Fatalf("couldn't defrag %s", err)
+	}
+
+	for written := 0; written <= MaxShardLevels; written++ {
+		name := "0123456789abcdef"[written:]
+		if _, err := os.Stat(l.CanonicalPath(name)); err != nil {
+			t.Fatalf("%s wasn't moved to %s: %s", name, path.Dir(l.CanonicalPath(name)), err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Package storage is where atomfs keeps the contents of atoms.
+package storage
+
+import (
+	"io"
+	"time"
+)
+
+// TempPrefix is the prefix of the names of objects that are still being
+// written. Implementations that can't hide in progress objects from List
+// should name them with this prefix, so that GC knows what they are.
+const TempPrefix = ".atomfs-tmp-"
+
+// Storage holds atoms' contents. Objects are named by the atom's file name
+// (see types.Atom.FileName), which may contain a "/". Operations on objects
+// that don't exist should fail with an error satisfying
+// errors.Is(err, os.ErrNotExist).
+type Storage interface {
+	// Open opens the object called name for reading.
+	Open(name string) (io.ReadCloser, error)
+	// Create starts writing a new object. It doesn't appear under its
+	// name until it has been entirely written and committed.
+	Create() (Writer, error)
+	// Remove deletes the object called name.
+	Remove(name string) error
+	// List lists every object in the store, including the temp objects
+	// of any writes in progress.
+	List() ([]FileInfo, error)
+	// Stat describes the object called name.
+	Stat(name string) (FileInfo, error)
+}
+
+// Writer writes a new object; see Storage.Create.
+type Writer interface {
+	io.Writer
+	// Commit atomically makes everything written so far visible as the
+	// object called name, replacing any existing object of that name.
+	Commit(name string) error
+	// Abort throws away everything written so far.
+	Abort() error
+}
+
+// FileInfo describes an object.
+type FileInfo struct {
+	Name string
+	Size int64
+	// ModTime is when the object was last modified, if the storage
+	// knows.
+	ModTime time.Time
+	// Inode and Links are the object's inode number and how many hard
+	// links it has, if the storage knows; otherwise they are zero.
+	// Objects with the same Inode share their space, which is only freed
+	// once all of the links are removed.
+	Inode uint64
+	Links uint64
+}
+
+// UniqueBytes returns how much space files take up, counting files that are
+// hard links to one another once.
+func UniqueBytes(files []FileInfo) int64 {
+	seen := map[uint64]bool{}
+	total := int64(0)
+	for _, f := range files {
+		if f.Inode != 0 {
+			if seen[f.Inode] {
+				continue
+			}
+			seen[f.Inode] = true
+		}
+		total += f.Size
+	}
+
+	return total
+}
+
+// ReclaimableBytes returns how much space removing files would free. A file
+// with hard links that aren't among files (e.g. in another store) doesn't
+// free anything, since its space is still used by the other links.
+func ReclaimableBytes(files []FileInfo) int64 {
+	removed := map[uint64]uint64{}
+	for _, f := range files {
+		removed[f.Inode]++
+	}
+
+	reclaimable := []FileInfo{}
+	for _, f := range files {
+		if f.Inode == 0 || removed[f.Inode] >= f.Links {
+			reclaimable = append(reclaimable, f)
+		}
+	}
+
+	return UniqueBytes(reclaimable)
+}
@@ -0,0 +1,153 @@
+package atomfs
+
+import (
+	"database/sql"
+	"io"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// Tx is a set of atomfs operations that are all applied to the db in a single
+// transaction; see WithTransaction.
+type Tx struct {
+	atomfs *Instance
+}
+
+// WithTransaction runs f with a Tx whose operations are all part of one db
+// transaction. If f returns nil the transaction is committed, otherwise it is
+// rolled back and f's error is returned. Events for changes made in the
+// transaction are only emitted once it commits.
+//
+// Note that atom files written during a transaction that is rolled back are
+// left on disk; the next GC will clean them up.
+func (atomfs *Instance) WithTransaction(f func(tx *Tx) error) error {
+	if err := atomfs.checkWritable(); err != nil {
+		return err
+	}
+
+	return atomfs.inTx(func(inTx *Instance) error {
+		return f(&Tx{inTx})
+	})
+}
+
+// inTx runs f with an Instance whose db operations are all part of one
+// transaction, like WithTransaction. If atomfs is already in a transaction, f
+// just runs inside of it.
+func (atomfs *Instance) inTx(f func(inTx *Instance) error) error {
+	if atomfs.pendingEvents != nil {
+		return f(atomfs)
+	}
+
+	release, err := atomfs.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	dbTx, err := atomfs.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	events := []Event{}
+	inTx := &Instance{
+		config:        atomfs.config,
+		db:            dbTx,
+		storage:       atomfs.storage,
+		eventHandler:  atomfs.eventHandler,
+		verifier:      atomfs.verifier,
+		metrics:       atomfs.metrics,
+		refs:          atomfs.refs,
+		pendingEvents: &events,
+	}
+
+	if err := f(inTx); err != nil {
+		dbTx.Rollback()
+		return err
+	}
+
+	if err := dbTx.Commit(); err != nil {
+		return err
+	}
+
+	if atomfs.eventHandler != nil {
+		for _, ev := range events {
+			atomfs.eventHandler(ev)
+		}
+	}
+
+	return nil
+}
+
+// Exec runs a statement against the db as part of the transaction, e.g. to
+// change a table registered with types.ExternalSchema along with the
+// molecules it describes. See also Instance.DB.
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.atomfs.db.Exec(query, args...)
+}
+
+// Query is like Exec, for queries that return rows.
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.atomfs.db.Query(query, args...)
+}
+
+// QueryRow is like Exec, for queries that return at most one row.
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.atomfs.db.QueryRow(query, args...)
+}
+
+func (tx *Tx) ImportAtom(r io.Reader) (types.Atom, error) {
+	return tx.atomfs.ImportAtom(r)
+}
+
+func (tx *Tx) ImportAtoms(readers ...io.Reader) ([]types.Atom, error) {
+	return tx.atomfs.ImportAtoms(readers...)
+}
+
+func (tx *Tx) GetAtoms() ([]types.Atom, error) {
+	return tx.atomfs.GetAtoms()
+}
+
+func (tx *Tx) GetAtom(hash string) (types.Atom, bool, error) {
+	return tx.atomfs.GetAtom(hash)
+}
+
+func (tx *Tx) HasAtom(hash string) (bool, error) {
+	return tx.atomfs.HasAtom(hash)
+}
+
+func (tx *Tx) CreateMolecule(name string, atoms []types.Atom) (types.Molecule, error) {
+	return tx.atomfs.CreateMolecule(name, atoms)
+}
+
+func (tx *Tx) CreateMoleculeFromHashes(name string, atomHashes []string) (types.Molecule, error) {
+	return tx.atomfs.CreateMoleculeFromHashes(name, atomHashes)
+}
+
+func (tx *Tx) EnsureMolecule(name string, atomHashes []string) (types.Molecule, bool, error) {
+	return tx.atomfs.EnsureMolecule(name, atomHashes)
+}
+
+func (tx *Tx) UpdateMolecule(name string, atomHashes []string) (types.Molecule, error) {
+	return tx.atomfs.UpdateMolecule(name, atomHashes)
+}
+
+func (tx *Tx) CopyMolecule(dest string, src string) (types.Molecule, error) {
+	return tx.atomfs.CopyMolecule(dest, src)
+}
+
+func (tx *Tx) MergeMolecules(dest string, sources ...string) (types.Molecule, error) {
+	return tx.atomfs.MergeMolecules(dest, sources...)
+}
+
+func (tx *Tx) RenameMolecule(old, new_ string) error {
+	return tx.atomfs.RenameMolecule(old, new_)
+}
+
+func (tx *Tx) DeleteMolecule(name string) error {
+	return tx.atomfs.DeleteMolecule(name)
+}
+
+func (tx *Tx) GetMolecule(name string) (types.Molecule, error) {
+	return tx.atomfs.GetMolecule(name)
+}
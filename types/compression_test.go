@@ -0,0 +1,42 @@
+package types
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	content := bytes.Repeat([]byte("atomfs "), 1000)
+
+	for _, c := range []Compression{"", NoCompression, GzipCompression, ZstdCompression} {
+		buf := bytes.Buffer{}
+		w, err := c.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("couldn't make %s writer %s", c, err)
+		}
+
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("couldn't write %s %s", c, err)
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatalf("couldn't close %s writer %s", c, err)
+		}
+
+		r, err := c.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("couldn't make %s reader %s", c, err)
+		}
+
+		read, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("couldn't read %s %s", c, err)
+		}
+
+		if !bytes.Equal(read, content) {
+			t.Fatalf("%s changed the content", c)
+		}
+	}
+}
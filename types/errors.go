@@ -0,0 +1,90 @@
+package types
+
+import (
+	"errors"
+)
+
+var (
+	// ErrMoleculeNotFound is returned (wrapped) when a molecule that
+	// doesn't exist is looked up.
+	ErrMoleculeNotFound = errors.New("molecule not found")
+	// ErrAtomNotFound is returned (wrapped) when an atom that doesn't
+	// exist is looked up.
+	ErrAtomNotFound = errors.New("atom not found")
+	// ErrMoleculeExists is returned (wrapped) when a molecule is created,
+	// renamed or restored with the name of one that already exists.
+	ErrMoleculeExists = errors.New("molecule already exists")
+	// ErrLocked is returned (wrapped) when the store, or its db, is locked
+	// by someone else for longer than we were willing to wait.
+	ErrLocked = errors.New("atomfs store is locked")
+	// ErrStoreFull is returned (wrapped) when importing an atom would
+	// take the store past Config.MaxAtoms or Config.MaxBytes.
+	ErrStoreFull = errors.New("atomfs store is full")
+	// ErrInvalidConfig is returned (wrapped) by Config.Validate.
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrReadOnly is returned by mutating operations on an Instance that
+	// was opened with Config.ReadOnly.
+	ErrReadOnly = errors.New("atomfs is read only")
+	// ErrClosed is returned by operations on an Instance that has been
+	// closed.
+	ErrClosed = errors.New("atomfs instance is closed")
+	// ErrAtomMissing is returned (wrapped) by VerifyAtom when the atom's
+	// file doesn't exist.
+	ErrAtomMissing = errors.New("atom missing")
+	// ErrAtomCorrupt is returned (wrapped) by VerifyAtom when the atom's
+	// contents don't match its hash.
+	ErrAtomCorrupt = errors.New("atom corrupt")
+	// ErrDigestMismatch is returned (wrapped) when imported content's
+	// digest isn't the one that was expected.
+	ErrDigestMismatch = errors.New("digest mismatch")
+	// ErrUntrustedAtom is returned (wrapped) by verifiers for atoms that
+	// aren't signed by any of their keys.
+	ErrUntrustedAtom = errors.New("atom is not signed by a trusted key")
+	// ErrAtomEncrypted is returned (wrapped) when an encrypted atom would
+	// have to be used as a plain file, e.g. to mount or export it.
+	ErrAtomEncrypted = errors.New("atom is encrypted")
+	// ErrDBUnhealthy is returned (wrapped) by Healthy when the db doesn't
+	// respond to a query.
+	ErrDBUnhealthy = errors.New("atomfs db is unhealthy")
+	// ErrAtomsDirUnhealthy is returned (wrapped) by Healthy when the atoms
+	// directory is missing, or can't be written to.
+	ErrAtomsDirUnhealthy = errors.New("atomfs atoms directory is unhealthy")
+	// ErrDB is the kind of the Errors that wrap whatever the db package
+	// gets back from sqlite, so that callers don't have to depend on the
+	// driver's error text.
+	ErrDB = errors.New("atomfs db error")
+)
+
+// Error is an error of a particular kind (one of the sentinel errors, e.g.
+// ErrLocked) that was caused by another error, e.g. one from sqlite or the
+// filesystem. errors.Is matches it against both Kind and Err, and
+// errors.Unwrap returns Err, so callers can branch on the kind without
+// losing the cause.
+type Error struct {
+	Kind error
+	// Detail says what the error is about, e.g. the name of the
+	// molecule. It may be empty.
+	Detail string
+	Err    error
+}
+
+// WrapError returns an Error of the given kind, caused by err.
+func WrapError(kind error, detail string, err error) error {
+	return &Error{Kind: kind, Detail: detail, Err: err}
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
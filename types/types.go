@@ -3,8 +3,20 @@
 package types
 
 import (
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"strings"
+	"time"
+
+	"github.com/anuvu/atomfs/storage"
+	"github.com/klauspost/compress/zstd"
 )
 
 type Atom struct {
@@ -12,6 +24,77 @@ type Atom struct {
 	Name string
 	Hash string
 	Type AtomType
+	// Algorithm is the digest algorithm Hash was computed with. The zero
+	// value means sha256, which is what all older atoms use.
+	Algorithm DigestAlgorithm
+	// Compression is how the atom's file is compressed on disk. Hash is
+	// always the hash of the uncompressed content.
+	Compression Compression
+	// Size is the size of the atom's file on disk, if SizeKnown is true.
+	// It isn't known for atoms imported by older versions of atomfs. For
+	// chunked atoms it is the size of the reassembled content.
+	Size      int64
+	SizeKnown bool
+	// MediaType is the OCI media type of the atom's content as it was
+	// imported (i.e. before any compression by atomfs), e.g.
+	// "application/vnd.oci.image.layer.v1.tar+gzip", or "" if it isn't
+	// known.
+	MediaType string
+	// Chunked atoms are kept as a list of chunks (whose files may be
+	// shared with other atoms) rather than as a file of their own. Their
+	// file is only reassembled when it is needed, e.g. to mount them.
+	Chunked bool
+	// KeyID is the Encrypter key that the atom's file is encrypted with,
+	// or "" if it isn't encrypted. Encryption happens after compression,
+	// and the atom's hash is always that of its plaintext.
+	KeyID string
+	// Pinned atoms are never pruned by GC, even if no molecule uses
+	// them.
+	Pinned bool
+}
+
+// Chunk is a piece of a chunked atom's content. Chunks are always named by
+// their sha256 hash.
+type Chunk struct {
+	Hash string
+	Size int64
+}
+
+// FileName is the path of the chunk's file, relative to the atoms directory.
+func (c Chunk) FileName() string {
+	return path.Join("chunks", c.Hash)
+}
+
+// Digest returns the atom's hash along with the algorithm that produced it.
+func (a Atom) Digest() Digest {
+	return Digest{a.Algorithm.orDefault(), a.Hash}
+}
+
+// FileName is the path of the atom's file, relative to the atoms directory.
+// sha256 atoms live at the top level (as they always have), and atoms using
+// other algorithms live in a subdirectory named after the algorithm, so that
+// atoms of different algorithms can never collide. Encrypted atoms' names
+// also have a suffix derived from their key id, so that an atom's file for a
+// new key can be written next to the one for its old key.
+func (a Atom) FileName() string {
+	name := a.Hash
+	if a.KeyID != "" {
+		name += "." + keyIDSuffix(a.KeyID)
+	}
+
+	alg := a.Algorithm.orDefault()
+	if alg == SHA256 {
+		return name
+	}
+
+	return path.Join(string(alg), name)
+}
+
+// keyIDSuffix turns keyID, which is chosen by the Encrypter and could contain
+// anything, into something that is safe to put in a file name.
+func keyIDSuffix(keyID string) string {
+	sum := sha256.Sum256([]byte(keyID))
+	return fmt.Sprintf("%x", sum[:8])
 }
 
 type Molecule struct {
@@ -22,12 +105,290 @@ type Molecule struct {
 	Atoms []Atom
 }
 
+// Mount is a record of a molecule that atomfs has mounted.
+type Mount struct {
+	Target   string
+	Molecule string
+	Time     time.Time
+}
+
+// FSCKRun is a record of a completed FSCK (of any kind that reads every
+// atom), whether or not it found any problems.
+type FSCKRun struct {
+	Started  time.Time
+	Finished time.Time
+	// Atoms is the number of atoms that were checked.
+	Atoms int
+	// Errors is the number of problems that were found; a clean run has
+	// none.
+	Errors int
+}
+
 type Config struct {
 	Path string
+	// ReadOnly opens the store without ever writing to it; any mutating
+	// operations will fail.
+	ReadOnly bool
+	// Compression is the codec new atoms are compressed with on disk. The
+	// zero value means NoCompression.
+	Compression Compression
+	// LockTimeout is how long to wait for another process to release
+	// the store's lock before giving up with atomfs.ErrLocked. The zero
+	// value means not to wait at all.
+	LockTimeout time.Duration
+	// SQLite tunes how the db is opened.
+	SQLite SQLiteOptions
+	// Retry is how db writes that fail because another connection has
+	// the db locked are retried.
+	Retry RetryPolicy
+	// Storage is where atoms' contents are kept. If it is nil, they are
+	// kept as files in AtomsPath(). Note that atoms can only be mounted
+	// from local storage.
+	Storage storage.Storage
+	// ShardLevels, if Storage is nil, splits the atoms directory into
+	// this many levels of subdirectories named after pairs of hex
+	// characters of the atoms' hashes, e.g. with 2, atom abcd... is kept
+	// at ab/cd/abcd.... This keeps huge stores from having huge
+	// directories. Atoms written with a different setting are still
+	// found; Instance.ReshardAtoms moves them to match this one.
+	ShardLevels int
+	// Logger receives log lines about what the Instance is doing. If it
+	// is nil, nothing is logged.
+	Logger Logger
+	// DeleteGracePeriod, if it isn't zero, makes deleting a molecule only
+	// hide it, so that it can be restored (with Instance.RestoreMolecule)
+	// for this long afterwards. Its atoms aren't freed until it is purged
+	// by GC or Instance.PurgeDeleted once the period is over.
+	DeleteGracePeriod time.Duration
+	// VerifyOnRead makes Instance.OpenAtom check atoms' contents against
+	// their hashes as they are read, and mounting check every atom of a
+	// molecule before mounting it. This costs a full read of each atom,
+	// but catches corruption of storage that can't be trusted.
+	VerifyOnRead bool
+	// ExternalSchemas are the schemas of tables that the user of atomfs
+	// keeps in atomfs' db; see ExternalSchema.
+	ExternalSchemas []ExternalSchema
+	// Encrypter, if it isn't nil, encrypts the files of new atoms. It is
+	// also needed to read atoms that were encrypted before. Encrypted
+	// atoms can be read (e.g. with Instance.OpenAtom) and checked, but not
+	// mounted or exported, since the kernel can't read them.
+	Encrypter Encrypter
+	// MaxAtoms and MaxBytes, if they aren't zero, limit how many atoms
+	// the store can have, and the total of their sizes. Importing an
+	// atom fails with ErrStoreFull, before any of it is written, once
+	// the store is at either limit. The size of an atom isn't known
+	// until it has been imported, so the last one may take the store
+	// past MaxBytes.
+	MaxAtoms int
+	MaxBytes int64
+}
+
+// Encrypter encrypts atoms' files at rest; see Config.Encrypter.
+type Encrypter interface {
+	// KeyID names the key that Encrypt currently uses. It is recorded
+	// with each atom it encrypts, so that they can still be decrypted
+	// after the key has been rotated.
+	KeyID() string
+	// Encrypt returns a writer that encrypts what is written to it with
+	// the current key, and writes the result to w. Closing it must
+	// flush it, but not close w.
+	Encrypt(w io.Writer) (io.WriteCloser, error)
+	// Decrypt returns a reader of the plaintext of r, which was written
+	// by Encrypt with the key called keyID.
+	Decrypt(keyID string, r io.Reader) (io.Reader, error)
+}
+
+// ExternalSchema is the schema of tables that something other than atomfs
+// keeps in atomfs' db, e.g. to record application metadata about molecules
+// in the same transactions that change them (see Instance.WithTransaction).
+//
+// Its migrations are applied in order when the db is opened read-write, after
+// atomfs' own, and the version reached is recorded under Name; like atomfs'
+// own, they must only ever be appended to. A read only db must already have
+// all of them. The tables should be named with a prefix of Name + "_", and
+// Name should be specific enough (e.g. "mybuilds") that this can't collide
+// with atomfs' own tables, which are named after atoms, molecules and the
+// like. They may reference molecules(id) or atoms(id), but only with ON DELETE
+// CASCADE, since atomfs deletes rows of those tables without knowing about
+// them.
+type ExternalSchema struct {
+	Name       string
+	Migrations []string
+}
+
+// Logger is a structured logger. Each method takes a message followed by
+// alternating keys and values, so e.g. a *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+
+// Log returns the logger to log to, which is a no-op if Logger is nil.
+func (c Config) Log() Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+
+	return nopLogger{}
+}
+
+// Validate checks that the config makes sense, returning an error wrapping
+// ErrInvalidConfig that describes the first problem it finds.
+func (c Config) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("%w: Path is empty", ErrInvalidConfig)
+	}
+
+	if !path.IsAbs(c.Path) {
+		return fmt.Errorf("%w: Path %s is not absolute", ErrInvalidConfig, c.Path)
+	}
+
+	if path.Clean(c.Path) == "/" {
+		return fmt.Errorf("%w: Path can't be /", ErrInvalidConfig)
+	}
+
+	switch c.Compression.orDefault() {
+	case NoCompression, GzipCompression, ZstdCompression:
+	default:
+		return fmt.Errorf("%w: unsupported compression %s", ErrInvalidConfig, string(c.Compression))
+	}
+
+	if c.ShardLevels < 0 || c.ShardLevels > storage.MaxShardLevels {
+		return fmt.Errorf("%w: ShardLevels must be between 0 and %d", ErrInvalidConfig, storage.MaxShardLevels)
+	}
+
+	if c.LockTimeout < 0 {
+		return fmt.Errorf("%w: LockTimeout %s is negative", ErrInvalidConfig, c.LockTimeout)
+	}
+
+	if c.DeleteGracePeriod < 0 {
+		return fmt.Errorf("%w: DeleteGracePeriod %s is negative", ErrInvalidConfig, c.DeleteGracePeriod)
+	}
+
+	if c.MaxAtoms < 0 || c.MaxBytes < 0 {
+		return fmt.Errorf("%w: MaxAtoms and MaxBytes can't be negative", ErrInvalidConfig)
+	}
+
+	names := map[string]bool{}
+	for _, schema := range c.ExternalSchemas {
+		if schema.Name == "" {
+			return fmt.Errorf("%w: external schema has no name", ErrInvalidConfig)
+		}
+
+		if names[schema.Name] {
+			return fmt.Errorf("%w: external schema %s is registered twice", ErrInvalidConfig, schema.Name)
+		}
+		names[schema.Name] = true
+	}
+
+	if c.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("%w: Retry.MaxAttempts %d is negative", ErrInvalidConfig, c.Retry.MaxAttempts)
+	}
+
+	if c.Retry.Backoff < 0 {
+		return fmt.Errorf("%w: Retry.Backoff %s is negative", ErrInvalidConfig, c.Retry.Backoff)
+	}
+
+	return c.SQLite.validate()
+}
+
+// AtomStorage returns the storage that atoms' contents are kept in.
+func (c Config) AtomStorage() storage.Storage {
+	if c.Storage != nil {
+		return c.Storage
+	}
+
+	if c.ShardLevels > 0 {
+		return storage.NewShardedLocal(c.AtomsPath(), c.ShardLevels)
+	}
+
+	return storage.NewLocal(c.AtomsPath())
+}
+
+// SQLiteOptions are sqlite settings that are applied to each connection to the
+// db. The zero value of each gets a sensible default.
+type SQLiteOptions struct {
+	// BusyTimeout is how long to wait for another connection to release
+	// the db before failing with "database is locked". Defaults to 5s.
+	BusyTimeout time.Duration
+	// JournalMode is sqlite's journal_mode, e.g. "WAL" or "DELETE". If
+	// it is empty, the db's mode isn't changed, so new dbs get sqlite's
+	// default (DELETE). "WAL" lets readers and a writer coexist, but a
+	// WAL db can only be opened read only where its -wal and -shm files
+	// can be created, so it can't be read from read only media. It is
+	// ignored for read only stores, which can't change it.
+	JournalMode string
+	// Synchronous is sqlite's synchronous level, e.g. "NORMAL" or "FULL".
+	// Defaults to sqlite's own default.
+	Synchronous string
+	// AutoVacuum is sqlite's auto_vacuum mode, "NONE", "FULL" or
+	// "INCREMENTAL". Defaults to sqlite's own default (NONE). Changing it
+	// for an existing db only takes effect after a Vacuum.
+	AutoVacuum string
+}
+
+// RetryPolicy describes how to retry an operation that failed transiently. The
+// zero value of each field gets a sensible default.
+type RetryPolicy struct {
+	// MaxAttempts is how many times to try in total, so 1 means not to
+	// retry at all. Defaults to 5.
+	MaxAttempts int
+	// Backoff is how long to wait before the first retry; the wait
+	// doubles after each attempt. Defaults to 50ms.
+	Backoff time.Duration
+}
+
+// Attempts returns MaxAttempts, or its default.
+func (p RetryPolicy) Attempts() int {
+	if p.MaxAttempts == 0 {
+		return 5
+	}
+	return p.MaxAttempts
+}
+
+// InitialBackoff returns Backoff, or its default.
+func (p RetryPolicy) InitialBackoff() time.Duration {
+	if p.Backoff == 0 {
+		return 50 * time.Millisecond
+	}
+	return p.Backoff
+}
+
+func (o SQLiteOptions) validate() error {
+	if o.BusyTimeout < 0 {
+		return fmt.Errorf("%w: SQLite.BusyTimeout %s is negative", ErrInvalidConfig, o.BusyTimeout)
+	}
+
+	switch strings.ToUpper(o.JournalMode) {
+	case "", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return fmt.Errorf("%w: unknown SQLite.JournalMode %s", ErrInvalidConfig, o.JournalMode)
+	}
+
+	switch strings.ToUpper(o.Synchronous) {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA", "0", "1", "2", "3":
+	default:
+		return fmt.Errorf("%w: unknown SQLite.Synchronous %s", ErrInvalidConfig, o.Synchronous)
+	}
+
+	switch strings.ToUpper(o.AutoVacuum) {
+	case "", "NONE", "FULL", "INCREMENTAL", "0", "1", "2":
+	default:
+		return fmt.Errorf("%w: unknown SQLite.AutoVacuum %s", ErrInvalidConfig, o.AutoVacuum)
+	}
+
+	return nil
 }
 
 func NewConfig(path string) (Config, error) {
-	config := Config{path}
+	config := Config{Path: path}
 
 	if err := os.MkdirAll(config.AtomsPath(), 0755); err != nil {
 		return Config{}, err
@@ -67,3 +428,137 @@ const (
 	TarAtom      AtomType = "tar"
 	SquashfsAtom AtomType = "squashfs"
 )
+
+type DigestAlgorithm string
+
+const (
+	SHA256 DigestAlgorithm = "sha256"
+	SHA512 DigestAlgorithm = "sha512"
+)
+
+// DigestAlgorithms are all of the digest algorithms atomfs can use.
+var DigestAlgorithms = []DigestAlgorithm{SHA256, SHA512}
+
+func (a DigestAlgorithm) orDefault() DigestAlgorithm {
+	if a == "" {
+		return SHA256
+	}
+	return a
+}
+
+// New returns a new hash.Hash that computes this algorithm.
+func (a DigestAlgorithm) New() (hash.Hash, error) {
+	switch a.orDefault() {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm %s", string(a))
+	}
+}
+
+// HashReader returns the hex encoded hash of everything read from r,
+// computed with this algorithm.
+func (a DigestAlgorithm) HashReader(r io.Reader) (string, error) {
+	h, err := a.New()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Digest is a content hash along with the algorithm that produced it.
+type Digest struct {
+	Algorithm DigestAlgorithm
+	Hash      string
+}
+
+func (d Digest) String() string {
+	return fmt.Sprintf("%s:%s", d.Algorithm.orDefault(), d.Hash)
+}
+
+// Validate checks that d's algorithm is supported, and that its hash is lower
+// case hex of the right length for it, so that it is safe to use in a file
+// name.
+func (d Digest) Validate() error {
+	h, err := d.Algorithm.New()
+	if err != nil {
+		return err
+	}
+
+	if len(d.Hash) != h.Size()*2 {
+		return fmt.Errorf("%s hash %q should be %d characters long", d.Algorithm.orDefault(), d.Hash, h.Size()*2)
+	}
+
+	for _, c := range d.Hash {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return fmt.Errorf("hash %q isn't lower case hex", d.Hash)
+		}
+	}
+
+	return nil
+}
+
+// Compression is a codec that atoms can be compressed with on disk.
+type Compression string
+
+const (
+	NoCompression   Compression = "none"
+	GzipCompression Compression = "gzip"
+	ZstdCompression Compression = "zstd"
+)
+
+func (c Compression) orDefault() Compression {
+	if c == "" {
+		return NoCompression
+	}
+	return c
+}
+
+// NewWriter returns a writer that compresses what is written to it into w.
+// Closing it flushes the compressed stream, but does not close w.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.orDefault() {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case GzipCompression:
+		return gzip.NewWriter(w), nil
+	case ZstdCompression:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", string(c))
+	}
+}
+
+// NewReader returns a reader of the decompressed contents of r. Closing it
+// does not close r.
+func (c Compression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c.orDefault() {
+	case NoCompression:
+		return ioutil.NopCloser(r), nil
+	case GzipCompression:
+		return gzip.NewReader(r)
+	case ZstdCompression:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", string(c))
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
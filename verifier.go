@@ -0,0 +1,66 @@
+package atomfs
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/anuvu/atomfs/types"
+)
+
+// ErrDigestMismatch is returned by ImportAtomExpecting when the content's
+// digest isn't the one that was expected. It is the same error as
+// types.ErrDigestMismatch.
+var ErrDigestMismatch = types.ErrDigestMismatch
+
+// ErrUntrustedAtom is returned by ED25519Verifier for atoms that aren't
+// signed by any of its keys. It is the same error as types.ErrUntrustedAtom.
+var ErrUntrustedAtom = types.ErrUntrustedAtom
+
+// Verifier decides whether an atom may be imported. Verify is called with the
+// digest of the atom's content before the atom is stored; if it returns an
+// error, the atom is neither stored on disk nor added to the db, and the
+// import fails with that error.
+type Verifier interface {
+	Verify(d types.Digest) error
+}
+
+// SetVerifier sets the Verifier that ImportAtom and ImportOCI (and friends)
+// check atoms with. Passing nil accepts all atoms. This should be called
+// before the Instance is used concurrently.
+func (atomfs *Instance) SetVerifier(v Verifier) {
+	atomfs.verifier = v
+}
+
+func (atomfs *Instance) verify(d types.Digest) error {
+	if atomfs.verifier == nil {
+		return nil
+	}
+
+	return atomfs.verifier.Verify(d)
+}
+
+// ED25519Verifier accepts atoms whose digest (in its "algorithm:hash" string
+// form) has been signed by any of Keys.
+type ED25519Verifier struct {
+	Keys []ed25519.PublicKey
+	// Signature looks up the signature of the atom with digest d. It
+	// should return a nil signature if there isn't one.
+	Signature func(d types.Digest) ([]byte, error)
+}
+
+func (v ED25519Verifier) Verify(d types.Digest) error {
+	sig, err := v.Signature(d)
+	if err != nil {
+		return err
+	}
+
+	if sig != nil {
+		for _, key := range v.Keys {
+			if ed25519.Verify(key, []byte(d.String()), sig) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrUntrustedAtom, d)
+}